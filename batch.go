@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// batchDescription describes the batch argument in the help of the commands that take it
+const batchDescription = " If batch is true, packages sharing a module and settings are tested by a single go test invocation, which compiles their shared dependencies once. Batched runs are not ordered."
+
+// errPackageFailed is the error of a package that failed within a batched go test run
+var errPackageFailed = errors.New("package failed")
+
+// batchRun makes test commands test many packages with each go test invocation
+var batchRun bool
+
+// testEvent is a line of go test -json output
+type testEvent struct {
+	Action     string
+	Package    string
+	ImportPath string
+	Test       string
+	Output     string
+}
+
+// testLine is a line of output from a batched run, along with the test that printed it
+type testLine struct {
+	test string
+	text string
+}
+
+// packageResult collects the output and outcome of one package from a batched run
+type packageResult struct {
+	lines       []testLine
+	failedTests map[string]bool
+	action      string
+}
+
+// output returns the output go test would have printed for the package if it had been
+// tested on its own. Unless verbose, only the output of failed tests is kept.
+func (r *packageResult) output(verbose bool) string {
+	var output strings.Builder
+	for _, line := range r.lines {
+		if !verbose {
+			if line.test != "" && !r.failedTests[line.test] {
+				continue
+			}
+			if strings.HasPrefix(line.text, "=== ") {
+				continue
+			}
+		}
+		output.WriteString(line.text)
+	}
+	return output.String()
+}
+
+// runJobsBatched runs go test jobs in batches, grouping the jobs in the same module
+// with the same environment and arguments into one invocation of go test -json, and
+// splits the results back out by package. The outputs are returned in the same order
+// as the jobs.
+func runJobsBatched(jobs []job) []cmdOutput {
+	modulePaths := make(map[string]string)
+	var groups [][]int
+	var roots []string
+	groupIndexes := make(map[string]int)
+	importPaths := make([]string, len(jobs))
+	for i, j := range jobs {
+		importPaths[i] = importPathFor(j.directory, modulePaths)
+		root := moduleRootFor(j.directory, modulePaths)
+		// Packages outside a module are tested on their own, in their own directory
+		if root == "" {
+			groups = append(groups, []int{i})
+			roots = append(roots, j.directory)
+			continue
+		}
+		key := strings.Join(append(append([]string{root}, j.env...), j.args...), "\x00")
+		if index, ok := groupIndexes[key]; ok {
+			groups[index] = append(groups[index], i)
+			continue
+		}
+		groupIndexes[key] = len(groups)
+		groups = append(groups, []int{i})
+		roots = append(roots, root)
+	}
+
+	outputs := make([]cmdOutput, len(jobs))
+	runParallel(len(groups), func(index int) cmdOutput {
+		group, root := groups[index], roots[index]
+		first := jobs[group[0]]
+
+		packages := make(map[string]int)
+		args := []string{first.args[0], "-json"}
+		for _, i := range group {
+			args = append(args, batchPackageArg(root, jobs[i].directory))
+			packages[importPaths[i]] = i
+		}
+		args = append(args, first.args[1:]...)
+
+		out, err := runShellCommandEnv(root, first.env, first.command, args...)
+		results := parseTestEvents(out, packages, group)
+		verbose := testsVerbose(args)
+		for _, i := range group {
+			result := results[i]
+			switch {
+			case result.action == "pass" || result.action == "skip":
+				outputs[i] = cmdOutput{jobs[i].directory, result.output(verbose), nil}
+			case result.action == "fail":
+				outputs[i] = cmdOutput{jobs[i].directory, result.output(verbose), errPackageFailed}
+			case err != nil:
+				// go test stopped before reporting on the package, so show why
+				outputs[i] = cmdOutput{jobs[i].directory, result.output(verbose) + out, err}
+			default:
+				outputs[i] = cmdOutput{jobs[i].directory, result.output(verbose), nil}
+			}
+		}
+		return cmdOutput{root, out, err}
+	})
+	return outputs
+}
+
+// parseTestEvents splits go test -json output by package, returning the result of
+// each job in group. Compiler errors printed outside the JSON stream are given to the
+// package named by the "# importpath" line above them. If the group holds a single
+// job, all of the output belongs to it.
+func parseTestEvents(out string, packages map[string]int, group []int) map[int]*packageResult {
+	results := make(map[int]*packageResult)
+	for _, i := range group {
+		results[i] = &packageResult{failedTests: make(map[string]bool)}
+	}
+	resultFor := func(importPath string) *packageResult {
+		// Test builds are named like "pkg [pkg.test]"
+		if space := strings.Index(importPath, " "); space != -1 {
+			importPath = importPath[:space]
+		}
+		if len(group) == 1 {
+			return results[group[0]]
+		}
+		if i, ok := packages[importPath]; ok {
+			return results[i]
+		}
+		return nil
+	}
+
+	var building *packageResult
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var event testEvent
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &event) != nil {
+			if strings.HasPrefix(line, "# ") {
+				building = resultFor(line[len("# "):])
+			}
+			if building != nil {
+				building.lines = append(building.lines, testLine{text: line + "\n"})
+			}
+			continue
+		}
+
+		if event.Action == "build-output" {
+			if result := resultFor(event.ImportPath); result != nil {
+				result.lines = append(result.lines, testLine{text: event.Output})
+			}
+			continue
+		}
+		result := resultFor(event.Package)
+		if result == nil {
+			continue
+		}
+		switch event.Action {
+		case "output":
+			result.lines = append(result.lines, testLine{event.Test, event.Output})
+		case "fail":
+			if event.Test != "" {
+				result.failedTests[event.Test] = true
+			} else {
+				result.action = event.Action
+			}
+		case "pass", "skip":
+			if event.Test == "" {
+				result.action = event.Action
+			}
+		}
+	}
+	return results
+}
+
+// testsVerbose determines if the go test arguments ask for verbose output
+func testsVerbose(args []string) bool {
+	for _, arg := range args {
+		if arg == "-args" {
+			return false
+		}
+		if arg == "-v" || arg == "-v=true" || arg == "-test.v" || arg == "-test.v=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// batchPackageArg returns the path of directory relative to root in the form go test
+// expects for a package argument
+func batchPackageArg(root, directory string) string {
+	relative := slashRelativePath(root, directory)
+	if relative == "." {
+		return relative
+	}
+	return "./" + relative
+}
@@ -0,0 +1,143 @@
+package main
+
+import "testing"
+
+// Output recorded from go test -json ./ok ./bad ./broken in a module named rec, where
+// ok passes, bad has a failing test and broken does not compile
+const (
+	recordedPass = `{"Action":"start","Package":"rec/ok"}
+{"Action":"run","Package":"rec/ok","Test":"TestOne"}
+{"Action":"output","Package":"rec/ok","Test":"TestOne","Output":"=== RUN   TestOne\n"}
+{"Action":"output","Package":"rec/ok","Test":"TestOne","Output":"--- PASS: TestOne (0.00s)\n"}
+{"Action":"pass","Package":"rec/ok","Test":"TestOne","Elapsed":0}
+{"Action":"output","Package":"rec/ok","Output":"PASS\n"}
+{"Action":"output","Package":"rec/ok","Output":"ok  \trec/ok\t0.004s\n"}
+{"Action":"pass","Package":"rec/ok","Elapsed":0.004}
+`
+
+	recordedFail = `{"Action":"start","Package":"rec/bad"}
+{"Action":"run","Package":"rec/bad","Test":"TestPass"}
+{"Action":"output","Package":"rec/bad","Test":"TestPass","Output":"=== RUN   TestPass\n"}
+{"Action":"output","Package":"rec/bad","Test":"TestPass","Output":"--- PASS: TestPass (0.00s)\n"}
+{"Action":"pass","Package":"rec/bad","Test":"TestPass","Elapsed":0}
+{"Action":"run","Package":"rec/bad","Test":"TestFail"}
+{"Action":"output","Package":"rec/bad","Test":"TestFail","Output":"=== RUN   TestFail\n"}
+{"Action":"output","Package":"rec/bad","Test":"TestFail","Output":"    bad_test.go:4: boom\n"}
+{"Action":"output","Package":"rec/bad","Test":"TestFail","Output":"--- FAIL: TestFail (0.00s)\n"}
+{"Action":"fail","Package":"rec/bad","Test":"TestFail","Elapsed":0}
+{"Action":"output","Package":"rec/bad","Output":"FAIL\n"}
+{"Action":"output","Package":"rec/bad","Output":"FAIL\trec/bad\t0.005s\n"}
+{"Action":"fail","Package":"rec/bad","Elapsed":0.005}
+`
+
+	// Before go1.24, compiler errors were printed outside the JSON stream
+	recordedBuildFailure = `# rec/broken [rec/broken.test]
+broken/broken_test.go:3:28: undefined: undefined
+{"Action":"start","Package":"rec/broken"}
+{"Action":"output","Package":"rec/broken","Output":"FAIL\trec/broken [build failed]\n"}
+{"Action":"fail","Package":"rec/broken","Elapsed":0}
+`
+
+	recordedBuildOutput = `{"ImportPath":"rec/broken [rec/broken.test]","Action":"build-output","Output":"# rec/broken [rec/broken.test]\n"}
+{"ImportPath":"rec/broken [rec/broken.test]","Action":"build-output","Output":"broken/broken_test.go:3:28: undefined: undefined\n"}
+{"ImportPath":"rec/broken [rec/broken.test]","Action":"build-fail"}
+{"Action":"start","Package":"rec/broken"}
+{"Action":"output","Package":"rec/broken","Output":"FAIL\trec/broken [build failed]\n","OutputType":"frame"}
+{"Action":"fail","Package":"rec/broken","Elapsed":0,"FailedBuild":"rec/broken [rec/broken.test]"}
+`
+)
+
+func TestParseTestEvents(t *testing.T) {
+	type want struct {
+		action string
+		output string
+	}
+	const (
+		passOutput   = "PASS\nok  \trec/ok\t0.004s\n"
+		failOutput   = "    bad_test.go:4: boom\n--- FAIL: TestFail (0.00s)\nFAIL\nFAIL\trec/bad\t0.005s\n"
+		brokenOutput = "# rec/broken [rec/broken.test]\nbroken/broken_test.go:3:28: undefined: undefined\nFAIL\trec/broken [build failed]\n"
+	)
+	packages := map[string]int{"rec/ok": 0, "rec/bad": 1, "rec/broken": 2}
+
+	tests := []struct {
+		name     string
+		out      string
+		packages map[string]int
+		group    []int
+		want     map[int]want
+	}{
+		{
+			name:     "pass and fail",
+			out:      recordedPass + recordedFail,
+			packages: packages,
+			group:    []int{0, 1},
+			want: map[int]want{
+				0: {"pass", passOutput},
+				1: {"fail", failOutput},
+			},
+		},
+		{
+			name:     "build failure printed outside the stream",
+			out:      recordedBuildFailure + recordedPass + recordedFail,
+			packages: packages,
+			group:    []int{0, 1, 2},
+			want: map[int]want{
+				0: {"pass", passOutput},
+				1: {"fail", failOutput},
+				2: {"fail", brokenOutput},
+			},
+		},
+		{
+			name:     "build failure in the stream",
+			out:      recordedPass + recordedBuildOutput + recordedFail,
+			packages: packages,
+			group:    []int{0, 1, 2},
+			want: map[int]want{
+				0: {"pass", passOutput},
+				1: {"fail", failOutput},
+				2: {"fail", brokenOutput},
+			},
+		},
+		{
+			name:     "package missing from the output",
+			out:      recordedPass,
+			packages: packages,
+			group:    []int{0, 2},
+			want: map[int]want{
+				0: {"pass", passOutput},
+				2: {"", ""},
+			},
+		},
+		{
+			// The import path of a lone package may not be known, as outside a module
+			name:     "single package group",
+			out:      recordedBuildFailure,
+			packages: map[string]int{"": 5},
+			group:    []int{5},
+			want: map[int]want{
+				5: {"fail", brokenOutput},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results := parseTestEvents(test.out, test.packages, test.group)
+			if len(results) != len(test.want) {
+				t.Fatalf("got results for %d jobs, want %d", len(results), len(test.want))
+			}
+			for i, want := range test.want {
+				result, ok := results[i]
+				if !ok {
+					t.Fatalf("no result for job %d", i)
+				}
+				if result.action != want.action {
+					t.Errorf("job %d: got action %q, want %q", i, result.action, want.action)
+				}
+				if output := result.output(false); output != want.output {
+					t.Errorf("job %d: got output\n%s\nwant\n%s", i, output, want.output)
+				}
+			}
+		})
+	}
+}
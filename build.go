@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildArgs are the go arguments used to compile a package, discarding the output
+var buildArgs = []string{"build", "-o", os.DevNull}
+
+// errExcludedByConstraints is the error of a job skipped because build constraints
+// exclude every file of its package from the platform it was to run for
+var errExcludedByConstraints = errors.New("excluded by build constraints")
+
+// platform is a GOOS/GOARCH combination to compile for. Empty fields mean the
+// host's value.
+type platform struct {
+	os   string
+	arch string
+}
+
+// String returns the platform in GOOS/GOARCH form
+func (p platform) String() string {
+	goos, goarch := p.os, p.arch
+	if goos == "" {
+		goos = "host"
+	}
+	if goarch == "" {
+		goarch = "host"
+	}
+	return fmt.Sprintf("%s/%s", goos, goarch)
+}
+
+// env returns the environment overrides that select the platform
+func (p platform) env() []string {
+	var env []string
+	if p.os != "" {
+		env = append(env, "GOOS="+p.os)
+	}
+	if p.arch != "" {
+		env = append(env, "GOARCH="+p.arch)
+	}
+	return env
+}
+
+// platformsFor returns every combination of the comma separated operating systems
+// and architectures. If neither is given, the host platform is the only one returned.
+func platformsFor(oses, arches string) []platform {
+	osList := splitList(oses)
+	archList := splitList(arches)
+	if len(osList) == 0 {
+		osList = []string{""}
+	}
+	if len(archList) == 0 {
+		archList = []string{""}
+	}
+
+	var platforms []platform
+	for _, goos := range osList {
+		for _, goarch := range archList {
+			platforms = append(platforms, platform{goos, goarch})
+		}
+	}
+	return platforms
+}
+
+// hasPackageFiles determines if directory holds any go files other than tests, since
+// go build fails in a directory that only holds tests
+func hasPackageFiles(directory string) bool {
+	files, _ := filepath.Glob(filepath.Join(directory, "*"+searchGo))
+	for _, file := range files {
+		if !strings.HasSuffix(file, searchTest) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildDirectories returns the directories selected by name that hold a package to
+// compile, leaving out those that only hold tests
+func buildDirectories(name string) []string {
+	var directories []string
+	for _, directory := range findDirectories(name, searchGo) {
+		if hasPackageFiles(directory) {
+			directories = append(directories, directory)
+		}
+	}
+	return directories
+}
+
+// constraintsExclude determines if the build constraints of the go files in the job's
+// directory leave nothing for its go command to act on, for the platform and tags it
+// runs with. Test files only count for go vet, which checks them too.
+func constraintsExclude(j job) bool {
+	context := buildContextFor(j)
+	tests := len(j.args) != 0 && j.args[0] == "vet"
+	files, _ := filepath.Glob(filepath.Join(j.directory, "*"+searchGo))
+	for _, file := range files {
+		if !tests && strings.HasSuffix(file, searchTest) {
+			continue
+		}
+		// Let the go command report files it cannot read
+		if match, err := context.MatchFile(j.directory, filepath.Base(file)); err != nil || match {
+			return false
+		}
+	}
+	return true
+}
+
+// runPlatformJobs runs the jobs in dependency order if ordered runs are enabled,
+// skipping those whose packages are excluded from their platform by build constraints
+// rather than letting the go command fail them. The outputs are returned in the same
+// order as the jobs.
+func runPlatformJobs(jobs []job) []cmdOutput {
+	outputs := make([]cmdOutput, len(jobs))
+	var runnable []job
+	var indexes []int
+	for i, j := range jobs {
+		if constraintsExclude(j) {
+			outputs[i] = cmdOutput{j.directory, "", errExcludedByConstraints}
+			continue
+		}
+		runnable = append(runnable, j)
+		indexes = append(indexes, i)
+	}
+	for i, output := range runJobsInOrder(runnable) {
+		outputs[indexes[i]] = output
+	}
+	return outputs
+}
+
+// buildPackages compiles every package in or below the current working directory,
+// including those without tests, once for each platform.
+func buildPackages(name string, platforms []platform, verbose bool) bool {
+	directories := buildDirectories(name)
+	failedPlatforms := 0
+
+	for _, p := range platforms {
+		if len(platforms) == 1 && p == (platform{}) {
+			fmt.Printf("\nBuilding packages: ")
+		} else {
+			fmt.Printf("\nBuilding packages for %s: ", p)
+		}
+
+		jobs := newJobs(directories, goCommand, buildArgs...)
+		for i := range jobs {
+			jobs[i].env = append(jobs[i].env, p.env()...)
+		}
+		outputs := runPlatformJobs(jobs)
+		run, failed := len(outputs), countAndPrintOutputs(outputs, verbose)
+
+		printSummary("packages", "built", run, failed)
+		if failed != 0 {
+			failedPlatforms++
+		}
+	}
+
+	if len(platforms) > 1 {
+		fmt.Printf("%d platforms built. %d succeeded. %d failed.\n\n", len(platforms), len(platforms)-failedPlatforms, failedPlatforms)
+	}
+
+	return failedPlatforms == 0
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// currentConfigVersion is the version of the configuration schema written by this gorc.
+//
+// Version history:
+//
+//	0  unversioned files written by earlier gorc releases
+//	1  adds the version key; timeout must be a duration string
+const currentConfigVersion = 1
+
+// configuration is the contents of a gorc configuration file, or of one of its profiles
+type configuration struct {
+	Version    int                       `json:"version,omitempty"`
+	Exclusions []string                  `json:"exclusions,omitempty"`
+	Timeout    string                    `json:"timeout,omitempty"`
+	Matrix     []string                  `json:"matrix,omitempty"`
+	Jobs       int                       `json:"jobs,omitempty"`
+	Tags       []string                  `json:"tags,omitempty"`
+	Race       *bool                     `json:"race,omitempty"`
+	Coverage   *bool                     `json:"coverage,omitempty"`
+	Flags      []string                  `json:"flags,omitempty"`
+	Env        map[string]string         `json:"env,omitempty"`
+	Parallel   int                       `json:"parallel,omitempty"`
+	Overrides  []*configOverride         `json:"overrides,omitempty"`
+	Profiles   map[string]*configuration `json:"profiles,omitempty"`
+
+	// unknown holds keys this gorc does not recognize, so they survive being rewritten
+	unknown map[string]json.RawMessage
+}
+
+// newConfiguration returns an empty configuration at the current version
+func newConfiguration() *configuration {
+	return &configuration{Version: currentConfigVersion, Exclusions: []string{}, Matrix: []string{}}
+}
+
+// configError describes a problem with a single key of a configuration file
+type configError struct {
+	key     string
+	message string
+}
+
+func (e configError) Error() string {
+	return fmt.Sprintf("\"%s\": %s", e.key, e.message)
+}
+
+// jsonType describes the type of a JSON value for error messages
+func jsonType(raw json.RawMessage) string {
+	var value interface{}
+	if json.Unmarshal(raw, &value) != nil {
+		return "invalid JSON"
+	}
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return fmt.Sprintf("boolean %t", v)
+	case float64:
+		return fmt.Sprintf("number %v", v)
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case []interface{}:
+		return "a list"
+	default:
+		return "an object"
+	}
+}
+
+// decodeStringList decodes a list of strings, treating null as empty
+func decodeStringList(key string, raw json.RawMessage) ([]string, error) {
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, configError{key, fmt.Sprintf("expected a list of strings, got %s", jsonType(raw))}
+	}
+	if values == nil {
+		values = []string{}
+	}
+	return values, nil
+}
+
+// migrateConfig upgrades the raw keys of a configuration file from an older version
+// of the schema to the current one, returning whether anything was changed.
+func migrateConfig(raw map[string]json.RawMessage, version int) bool {
+	if version >= currentConfigVersion {
+		return false
+	}
+
+	// Version 0 files may hold the timeout as a number of seconds
+	if value, ok := raw[configKeyTimeout]; ok {
+		var seconds float64
+		if json.Unmarshal(value, &seconds) == nil {
+			raw[configKeyTimeout], _ = json.Marshal(time.Duration(seconds * float64(time.Second)).String())
+		}
+	}
+
+	raw[configKeyVersion], _ = json.Marshal(currentConfigVersion)
+	return true
+}
+
+// parseConfig decodes and validates the contents of a configuration file, migrating
+// it from an older schema if necessary. Files without a version key are taken to be
+// at defaultVersion. Every problem found is returned, rather than just the first.
+func parseConfig(data []byte, defaultVersion int) (config *configuration, migrated bool, errs []error) {
+	config = newConfiguration()
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return config, false, []error{fmt.Errorf("the file does not hold a configuration object: %s", err)}
+	}
+
+	version := defaultVersion
+	if value, ok := raw[configKeyVersion]; ok {
+		if err := json.Unmarshal(value, &version); err != nil || version < 0 {
+			return config, false, []error{configError{configKeyVersion, fmt.Sprintf("expected a positive whole number, got %s", jsonType(value))}}
+		}
+		if version > currentConfigVersion {
+			return config, false, []error{configError{configKeyVersion, fmt.Sprintf("version %d is newer than this gorc supports (%d); please upgrade gorc", version, currentConfigVersion)}}
+		}
+	}
+	migrated = migrateConfig(raw, version)
+
+	return config, migrated, config.decode(raw, true)
+}
+
+// decodeBool decodes a boolean value
+func decodeBool(key string, raw json.RawMessage) (*bool, error) {
+	var value bool
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, configError{key, fmt.Sprintf("expected true or false, got %s", jsonType(raw))}
+	}
+	return &value, nil
+}
+
+// decode validates each key of a configuration object and stores its value. Profiles
+// are only allowed at the top level of a file.
+func (config *configuration) decode(raw map[string]json.RawMessage, allowProfiles bool) (errs []error) {
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := raw[key]
+		var err error
+		switch key {
+		case configKeyVersion:
+			if !allowProfiles {
+				err = configError{key, "the version can only be set at the top level of the file"}
+			}
+			config.Version = currentConfigVersion
+		case configKeyJobs:
+			if json.Unmarshal(value, &config.Jobs) != nil || config.Jobs < 0 {
+				err = configError{key, fmt.Sprintf("expected a positive whole number of commands to run at once, got %s", jsonType(value))}
+			}
+		case configKeyTags:
+			config.Tags, err = decodeStringList(key, value)
+		case configKeyFlags:
+			config.Flags, err = decodeStringList(key, value)
+			for _, flag := range config.Flags {
+				if err == nil && !strings.HasPrefix(flag, "-") {
+					err = configError{key, fmt.Sprintf("\"%s\" is not a flag; flags must begin with - and give any value after =, as in -run=Integration", flag)}
+				}
+			}
+		case configKeyEnv:
+			if json.Unmarshal(value, &config.Env) != nil {
+				err = configError{key, fmt.Sprintf("expected an object of environment variable names and values, got %s", jsonType(value))}
+			}
+			for name := range config.Env {
+				if err == nil && (name == "" || strings.Contains(name, "=")) {
+					err = configError{key, fmt.Sprintf("\"%s\" is not a valid environment variable name", name)}
+				}
+			}
+		case configKeyParallel:
+			if json.Unmarshal(value, &config.Parallel) != nil || config.Parallel < 0 {
+				err = configError{key, fmt.Sprintf("expected a positive whole number of tests to run in parallel, got %s", jsonType(value))}
+			}
+		case configKeyOverrides:
+			var overrideErrs []error
+			config.Overrides, overrideErrs = decodeOverrides(key, value)
+			errs = append(errs, overrideErrs...)
+		case configKeyRace:
+			config.Race, err = decodeBool(key, value)
+		case configKeyCoverage:
+			config.Coverage, err = decodeBool(key, value)
+		case configKeyProfiles:
+			if !allowProfiles {
+				err = configError{key, "profiles cannot be nested inside a profile"}
+				break
+			}
+			var profiles map[string]json.RawMessage
+			if json.Unmarshal(value, &profiles) != nil {
+				err = configError{key, fmt.Sprintf("expected an object of named profiles, got %s", jsonType(value))}
+				break
+			}
+			config.Profiles = make(map[string]*configuration)
+			for name, profileValue := range profiles {
+				var profileRaw map[string]json.RawMessage
+				if json.Unmarshal(profileValue, &profileRaw) != nil {
+					errs = append(errs, configError{key + "." + name, fmt.Sprintf("expected an object of settings, got %s", jsonType(profileValue))})
+					continue
+				}
+				profile := &configuration{}
+				for _, profileErr := range profile.decode(profileRaw, false) {
+					if keyErr, ok := profileErr.(configError); ok {
+						profileErr = configError{key + "." + name + "." + keyErr.key, keyErr.message}
+					}
+					errs = append(errs, profileErr)
+				}
+				config.Profiles[name] = profile
+			}
+		case configKeyExclusions:
+			config.Exclusions, err = decodeStringList(key, value)
+			for _, exclusion := range config.Exclusions {
+				if _, patternErr := compileExclusion(exclusion); err == nil && patternErr != nil {
+					err = configError{key, patternErr.Error()}
+				}
+			}
+		case configKeyTimeout:
+			if json.Unmarshal(value, &config.Timeout) != nil {
+				err = configError{key, fmt.Sprintf("expected a duration string such as \"30s\", got %s", jsonType(value))}
+			} else if _, parseErr := time.ParseDuration(config.Timeout); config.Timeout != "" && parseErr != nil {
+				err = configError{key, fmt.Sprintf("\"%s\" is not a valid duration, expected a value such as \"30s\" or \"10m\"", config.Timeout)}
+			}
+		case configKeyMatrix:
+			config.Matrix, err = decodeStringList(key, value)
+			for _, entry := range config.Matrix {
+				if _, platformErr := parsePlatform(entry); err == nil && platformErr != nil {
+					err = configError{key, platformErr.Error()}
+				}
+			}
+		default:
+			if config.unknown == nil {
+				config.unknown = make(map[string]json.RawMessage)
+			}
+			config.unknown[key] = value
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// parseConfigFile decodes and validates the contents of the configuration file at path,
+// in whichever format the file is written. Only JSON files can predate versioning;
+// other formats were introduced at version 1.
+func parseConfigFile(path string, data []byte) (*configuration, bool, []error) {
+	converted, err := decodeConfigFile(path, data)
+	if err != nil {
+		return newConfiguration(), false, []error{err}
+	}
+	defaultVersion := 0
+	if formatForPath(path).name != configFormats[0].name {
+		defaultVersion = 1
+	}
+	return parseConfig(converted, defaultVersion)
+}
+
+// unknownKeys returns the sorted keys of the configuration that gorc does not recognize
+func (c *configuration) unknownKeys() []string {
+	keys := make([]string, 0, len(c.unknown))
+	for key := range c.unknown {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// empty determines if the configuration holds no settings, allowing the configuration file to be deleted
+func (c *configuration) empty() bool {
+	return len(c.Exclusions) == 0 && c.Timeout == "" && len(c.Matrix) == 0 && c.Jobs == 0 && len(c.Tags) == 0 &&
+		c.Race == nil && c.Coverage == nil && len(c.Flags) == 0 && len(c.Env) == 0 && c.Parallel == 0 &&
+		len(c.Overrides) == 0 && len(c.Profiles) == 0 && len(c.unknown) == 0
+}
+
+// merge applies the settings of other over those of the configuration. Exclusions,
+// flags, environment variables and overrides accumulate, while other settings are
+// replaced where other sets them. Neither configuration's lists are modified.
+func (c *configuration) merge(other *configuration) {
+	c.Exclusions = append(append([]string{}, c.Exclusions...), other.Exclusions...)
+	c.Flags = append(append([]string{}, c.Flags...), other.Flags...)
+	c.Overrides = append(append([]*configOverride{}, c.Overrides...), other.Overrides...)
+	if len(other.Env) != 0 {
+		env := make(map[string]string, len(c.Env)+len(other.Env))
+		for _, variables := range []map[string]string{c.Env, other.Env} {
+			for name, value := range variables {
+				env[name] = value
+			}
+		}
+		c.Env = env
+	}
+	if other.Parallel != 0 {
+		c.Parallel = other.Parallel
+	}
+	if other.Timeout != "" {
+		c.Timeout = other.Timeout
+	}
+	if len(other.Matrix) != 0 {
+		c.Matrix = other.Matrix
+	}
+	if other.Jobs != 0 {
+		c.Jobs = other.Jobs
+	}
+	if len(other.Tags) != 0 {
+		c.Tags = other.Tags
+	}
+	if other.Race != nil {
+		c.Race = other.Race
+	}
+	if other.Coverage != nil {
+		c.Coverage = other.Coverage
+	}
+}
+
+// withProfile returns the configuration with the named profile applied over it, if
+// the configuration defines that profile.
+func (c *configuration) withProfile(name string) *configuration {
+	profile, ok := c.Profiles[name]
+	if name == "" || !ok {
+		return c
+	}
+	applied := *c
+	applied.merge(profile)
+	return &applied
+}
+
+// enabled determines if an optional boolean setting is set to true
+func enabled(setting *bool) bool {
+	return setting != nil && *setting
+}
+
+// MarshalJSON encodes the configuration, including any keys gorc does not recognize
+func (c *configuration) MarshalJSON() ([]byte, error) {
+	type plain configuration
+	known, err := json.Marshal((*plain)(c))
+	if err != nil || len(c.unknown) == 0 {
+		return known, err
+	}
+
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(known, &merged); err != nil {
+		return nil, err
+	}
+	for key, value := range c.unknown {
+		merged[key] = value
+	}
+	return json.Marshal(merged)
+}
+
+// validateConfigFiles checks each configuration file, printing every problem found,
+// and returns whether they are all valid.
+func validateConfigFiles(paths []string) bool {
+	if len(paths) == 0 {
+		fmt.Printf("\nNo configuration files were found.\n\n")
+		return true
+	}
+
+	valid := 0
+	fmt.Println()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Printf("%s:\n\t%s\n", path, err)
+			continue
+		}
+		config, migrated, errs := parseConfigFile(path, data)
+		if len(errs) == 0 {
+			valid++
+			fmt.Printf("%s: ok\n", path)
+		} else {
+			fmt.Printf("%s:\n", path)
+			for _, err := range errs {
+				fmt.Printf("\terror: %s\n", err)
+			}
+		}
+		if migrated {
+			fmt.Printf("\tnote: the file uses an older configuration version; run gorc config migrate to update it to version %d\n", currentConfigVersion)
+		}
+		if preferred := configFileIn(filepath.Dir(path), filepath.Base(configBasePath(path))); preferred != path {
+			fmt.Printf("\twarning: this file is ignored because %s takes precedence\n", filepath.Base(preferred))
+		}
+		for _, key := range config.unknownKeys() {
+			fmt.Printf("\twarning: \"%s\" is not a recognized key and will be ignored\n", key)
+		}
+	}
+	fmt.Printf("\n%d files. %d valid. %d invalid.\n\n", len(paths), valid, len(paths)-valid)
+
+	return valid == len(paths)
+}
@@ -7,6 +7,39 @@ const (
 	// configKeyTimeout is the string for the key in the configuration object at which the timeout is stored
 	configKeyTimeout = "timeout"
 
+	// configKeyMatrix is the string for the key in the configuration object at which the GOOS/GOARCH build matrix is stored
+	configKeyMatrix = "matrix"
+
+	// configKeyJobs is the string for the key in the configuration object at which the number of commands to run at once is stored
+	configKeyJobs = "jobs"
+
+	// configKeyTags is the string for the key in the configuration object at which the build tags are stored
+	configKeyTags = "tags"
+
+	// configKeyRace is the string for the key in the configuration object at which whether tests run with the race detector is stored
+	configKeyRace = "race"
+
+	// configKeyCoverage is the string for the key in the configuration object at which whether tests report coverage is stored
+	configKeyCoverage = "coverage"
+
+	// configKeyFlags is the string for the key in the configuration object at which extra go test flags are stored
+	configKeyFlags = "flags"
+
+	// configKeyEnv is the string for the key in the configuration object at which environment variables for commands are stored
+	configKeyEnv = "env"
+
+	// configKeyParallel is the string for the key in the configuration object at which the go test -parallel value is stored
+	configKeyParallel = "parallel"
+
+	// configKeyOverrides is the string for the key in the configuration object at which the per-directory overrides are stored
+	configKeyOverrides = "overrides"
+
+	// configKeyProfiles is the string for the key in the configuration object at which the named profiles are stored
+	configKeyProfiles = "profiles"
+
+	// configKeyVersion is the string for the key in the configuration object at which the schema version is stored
+	configKeyVersion = "version"
+
 	// configFilename is the string for the name of the gorc configuration file
 	configFilename = ".gorc"
 )
@@ -18,6 +51,57 @@ const (
 	// errorRecursingDirectories is printed when an error occurs recursing through the directory structure.
 	errorRecursingDirectories = "There was an error when attempting to recurse directories: %s"
 
+	// errorInvalidPlatform is printed when a build matrix entry is not in GOOS/GOARCH form.
+	errorInvalidPlatform = "The build matrix entry \"%s\" is not in GOOS/GOARCH form (e.g. linux/amd64)."
+
+	// errorUnknownModAction is printed when the mod command is given an action it does not support.
+	errorUnknownModAction = "Unknown mod action \"%s\". Expected one of %s, %s or %s.\n\n"
+
+	// errorTidyCheckUnsupported is printed when the go command is too old to check a module is tidy without changing it.
+	errorTidyCheckUnsupported = "%s: %s cannot check a module is tidy without changing it, go1.14 or later is needed"
+
+	// errorReadingWorkspace is printed when the go.work file exists but cannot be read.
+	errorReadingWorkspace = "There was an error reading your go.work file: %s\n\n"
+
+	// errorInvalidPattern is returned when an exclusion pattern cannot be compiled.
+	errorInvalidPattern = "The exclusion pattern \"%s\" is invalid: %s"
+
+	// errorUnknownFormat is returned when a configuration format is not supported.
+	errorUnknownFormat = "unknown configuration format \"%s\", expected json, yaml or toml"
+
+	// errorConvertTargetExists is returned when converting a configuration file would replace another.
+	errorConvertTargetExists = "%s already exists; add force=true to replace it"
+
+	// errorUnknownProfile is printed when the selected profile is not defined by any configuration file.
+	errorUnknownProfile = "\nThe profile \"%s\" is not defined in any configuration file.\n\n"
+
+	// errorConfigLocked is returned when another gorc holds the lock on a configuration file for too long.
+	errorConfigLocked = "timed out waiting for another gorc to finish editing %s after %s"
+
+	// errorInvalidEnv is returned when an environment variable is not in KEY=VALUE form.
+	errorInvalidEnv = "\"%s\" is not an environment variable in KEY=VALUE form"
+
+	// errorInvalidTarget is printed when the name argument cannot be parsed.
+	errorInvalidTarget = "\nThe name \"%s\" is not a valid target: %s\n\n"
+
+	// errorInvalidTestArg is returned when a test filtering argument cannot be used.
+	errorInvalidTestArg = "The %s argument \"%s\" is invalid: %s"
+
+	// errorToolchainVersion is returned when the version of a go command cannot be worked out.
+	errorToolchainVersion = "could not determine the version of %s: %s"
+
+	// errorInvalidToolchain is returned when a toolchain given by the go argument is not a go release.
+	errorInvalidToolchain = "\"%s\" is not a go release, expected a name like go1.22 or go1.22.5"
+
+	// errorToolchainNotFound is returned when a toolchain is not installed and the active go cannot switch to it.
+	errorToolchainNotFound = "%s is not installed (see golang.org/dl), and %s is too old to switch to it with GOTOOLCHAIN"
+
+	// errorUnsupportedTestFlag is returned when a go release does not support a flag selecting which tests run.
+	errorUnsupportedTestFlag = "%s does not support %s, which needs %s or later"
+
+	// errorToolchainPatchNeeded is returned when a toolchain named without its patch release is not installed.
+	errorToolchainPatchNeeded = "%s is not installed, and switching to it with GOTOOLCHAIN needs a full release such as %s.0"
+
 	// errorCurrentDirectory is printed when an error occurs attempting to get the current working directory.
 	errorCurrentDirectory = "There was an error attempting to get directory in which gorc is being run: %s"
 )
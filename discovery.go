@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+const (
+	// statusSelected marks a directory the command will run in
+	statusSelected = "selected"
+
+	// statusExcluded marks a directory excluded by a configuration file
+	statusExcluded = "excluded"
+
+	// statusIgnored marks a directory ignored by a .gitignore or .gorcignore file
+	statusIgnored = "ignored"
+
+	// statusNoFiles marks a directory without any files the command acts on
+	statusNoFiles = "no matching files"
+
+	// statusNoTests marks a directory without any tests selected by the run and skip arguments
+	statusNoTests = "no matching tests"
+
+	// statusNotSelected marks a directory the name argument does not select
+	statusNotSelected = "not selected"
+
+	// statusOutsideWorkspace marks a module that is not used by the go.work file
+	statusOutsideWorkspace = "outside workspace"
+
+	// statusUnreadable marks a directory that could not be read
+	statusUnreadable = "unreadable"
+)
+
+// directoryStatus describes what gorc does with a directory it walked, and why
+type directoryStatus struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+
+	directory string
+}
+
+// discoverDirectories walks the current working directory, or in a go workspace each
+// workspace module, and returns the status of every directory visited, sorted by
+// path. Directories that are excluded or ignored are listed, but not walked below.
+func discoverDirectories(target, search string) ([]directoryStatus, []error) {
+	directory, err := getwd()
+	if err != nil {
+		return nil, nil
+	}
+
+	var targets packageTargets
+	if target != "" && target != targetAll {
+		if targets, err = parseTargets(target, directory); err != nil {
+			fmt.Printf(errorInvalidTarget, target, err)
+			os.Exit(1)
+		}
+	}
+
+	// Directories named directly are run even if they are excluded, so excluded
+	// directories can only be pruned while walking if nothing is named directly
+	prune := target != targetAll && !targets.hasExact()
+
+	roots := []string{directory}
+	if workspaceModules != nil {
+		roots = workspaceModules
+	}
+
+	var statuses []directoryStatus
+	var errs []error
+	var lock sync.Mutex
+	add := func(currentDirectory, status, reason string) {
+		lock.Lock()
+		statuses = append(statuses, directoryStatus{relativePath(currentDirectory), status, reason, currentDirectory})
+		lock.Unlock()
+	}
+
+	for _, root := range roots {
+		root := root
+		ignores := newIgnoreMatcher(root)
+		errs = append(errs, recurseDirectories(root, search,
+			func(currentDirectory string) bool {
+				if filepath.Base(currentDirectory) == gitDirectory {
+					return true
+				}
+				if !noIgnore {
+					if reason, ignored := ignores.ignoredBy(currentDirectory); ignored {
+						add(currentDirectory, statusIgnored, reason)
+						return true
+					}
+				}
+				if workspaceModules != nil && isModuleRoot(currentDirectory) {
+					// Workspace modules are searched as roots of their own
+					if used, _ := sliceContainsString(currentDirectory, workspaceModules); !used {
+						add(currentDirectory, statusOutsideWorkspace, "the module is not used by "+workspaceFilename)
+					}
+					return true
+				}
+				if prune {
+					if reason, excluded := configs.excludedBy(currentDirectory); excluded {
+						add(currentDirectory, statusExcluded, reason)
+						return true
+					}
+				}
+				return false
+			},
+			func(currentDirectory string, matched bool) {
+				status, reason := directoryStatusFor(root, directory, currentDirectory, matched, search, targets, prune)
+				add(currentDirectory, status, reason)
+			})...)
+	}
+
+	// Directories that could not be read are reported as such, rather than as empty
+	unreadable := make(map[string]string)
+	for _, err := range errs {
+		if walkErr, ok := err.(walkError); ok {
+			unreadable[walkErr.directory] = walkErr.err.Error()
+		}
+	}
+	for i := range statuses {
+		if reason, ok := unreadable[statuses[i].directory]; ok {
+			statuses[i].Status, statuses[i].Reason = statusUnreadable, reason
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].directory < statuses[j].directory
+	})
+	return statuses, errs
+}
+
+// directoryStatusFor returns the status of a directory that was walked, and why
+func directoryStatusFor(root, workingDirectory, directory string, matched bool, search string, targets packageTargets, prune bool) (string, string) {
+	if !matched {
+		return statusNoFiles, fmt.Sprintf("no %s files", searchDescriptions[search])
+	}
+	if search == searchTest && !hasMatchingTests(directory) {
+		return statusNoTests, "no tests match the run and skip arguments"
+	}
+	if targets != nil {
+		selected, exact := targets.selects(slashRelativePath(workingDirectory, directory))
+		if !selected {
+			return statusNotSelected, "not selected by the name argument"
+		}
+		if !exact && !prune {
+			if reason, excluded := excludedWithin(root, directory); excluded {
+				return statusExcluded, reason
+			}
+		}
+	}
+	return statusSelected, ""
+}
+
+// excludedWithin determines if directory, or any directory between it and root, is
+// excluded, and if so describes the pattern that excludes it
+func excludedWithin(root, directory string) (string, bool) {
+	for current := directory; current != root && filepath.Dir(current) != current; current = filepath.Dir(current) {
+		if reason, excluded := configs.excludedBy(current); excluded {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// searchDescriptions describes the files each search looks for
+var searchDescriptions = map[string]string{
+	searchTest:   "*" + searchTest,
+	searchGo:     "*" + searchGo,
+	searchModule: searchModule,
+}
+
+// searchForCommand returns the search a command uses to find the directories it acts on
+func searchForCommand(command string) (string, bool) {
+	switch command {
+	case "", "test", "cover", "race", "install":
+		return searchTest, true
+	case "build", "vet", "lint", "generate":
+		return searchGo, true
+	case "mod":
+		return searchModule, true
+	}
+	return "", false
+}
+
+// printDirectoryStatuses prints the status of each directory as a table, or as JSON
+// if format is "json", returning false if the format is not recognized
+func printDirectoryStatuses(statuses []directoryStatus, format string) bool {
+	switch format {
+	case "json":
+		if statuses == nil {
+			statuses = []directoryStatus{}
+		}
+		data, _ := json.MarshalIndent(statuses, "", "  ")
+		fmt.Println(string(data))
+	case "", "text":
+		selected := 0
+		fmt.Println()
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, status := range statuses {
+			if status.Status == statusSelected {
+				selected++
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", status.Path, status.Status, status.Reason)
+		}
+		writer.Flush()
+		fmt.Printf("\n%d directories. %d selected. %d skipped.\n\n", len(statuses), selected, len(statuses)-selected)
+	default:
+		fmt.Printf("\nUnknown format \"%s\". Expected text or json.\n\n", format)
+		return false
+	}
+	return true
+}
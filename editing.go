@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// documentEditor sets, or removes if value is nil, a top level key of a configuration
+// document, leaving the rest of the document as it was written.
+type documentEditor func(data []byte, key string, value json.RawMessage) ([]byte, error)
+
+// detectIndent returns the leading whitespace of the first indented line in data,
+// or fallback if no line is indented.
+func detectIndent(data []byte, fallback string) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) != len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return fallback
+}
+
+// editJSON edits a JSON object, keeping the order of its keys and, if the object was
+// spread over several lines, its indentation.
+func editJSON(data []byte, key string, value json.RawMessage) ([]byte, error) {
+	var keys []string
+	values := make(map[string]json.RawMessage)
+
+	if len(bytes.TrimSpace(data)) != 0 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+			return nil, fmt.Errorf("the file does not hold a configuration object")
+		}
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return nil, err
+			}
+			name := token.(string)
+			if _, ok := values[name]; !ok {
+				keys = append(keys, name)
+			}
+			values[name] = raw
+		}
+	}
+
+	if _, ok := values[key]; !ok && value != nil {
+		keys = append(keys, key)
+	}
+	values[key] = value
+
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	first := true
+	for _, name := range keys {
+		if values[name] == nil {
+			continue
+		}
+		if !first {
+			buffer.WriteString(",")
+		}
+		first = false
+		encodedName, _ := json.Marshal(name)
+		buffer.Write(encodedName)
+		buffer.WriteString(":")
+		buffer.Write(values[name])
+	}
+	buffer.WriteString("}")
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, buffer.Bytes()); err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(bytes.TrimSpace(data), []byte("\n")) {
+		return compacted.Bytes(), nil
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, compacted.Bytes(), "", detectIndent(data, "  ")); err != nil {
+		return nil, err
+	}
+	indented.WriteString("\n")
+	return indented.Bytes(), nil
+}
+
+// editYAML edits a YAML mapping, keeping its comments and the order of its keys
+func editYAML(data []byte, key string, value json.RawMessage) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if document.Kind == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	mapping := document.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("the file does not hold a configuration object")
+	}
+
+	index := -1
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			index = i
+		}
+	}
+
+	switch {
+	case value == nil:
+		if index >= 0 {
+			mapping.Content = append(mapping.Content[:index], mapping.Content[index+2:]...)
+		}
+	case index >= 0 && editYAMLList(mapping.Content[index+1], value):
+		// Lists are edited entry by entry, so the entries that remain keep their comments
+	default:
+		var decoded interface{}
+		if err := json.Unmarshal(value, &decoded); err != nil {
+			return nil, err
+		}
+		valueNode := &yaml.Node{}
+		if err := valueNode.Encode(decoded); err != nil {
+			return nil, err
+		}
+		if index >= 0 {
+			previous := mapping.Content[index+1]
+			valueNode.HeadComment, valueNode.LineComment, valueNode.FootComment = previous.HeadComment, previous.LineComment, previous.FootComment
+			mapping.Content[index+1] = valueNode
+		} else {
+			keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+			mapping.Content = append(mapping.Content, keyNode, valueNode)
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(len(detectIndent(data, "  ")))
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+	return buffer.Bytes(), nil
+}
+
+// editYAMLList replaces the entries of a sequence of scalars with the strings in value,
+// keeping the node of each entry that remains, so the comments on it stay with it. It
+// returns false, leaving the sequence alone, if the node is not a sequence of scalars
+// or value is not a list of strings.
+func editYAMLList(sequence *yaml.Node, value json.RawMessage) bool {
+	var values []string
+	if sequence.Kind != yaml.SequenceNode || json.Unmarshal(value, &values) != nil {
+		return false
+	}
+	existing := make(map[string][]*yaml.Node)
+	for _, entry := range sequence.Content {
+		if entry.Kind != yaml.ScalarNode {
+			return false
+		}
+		existing[entry.Value] = append(existing[entry.Value], entry)
+	}
+
+	// A comment below the last entry belongs to the end of the list
+	var footComment string
+	if count := len(sequence.Content); count != 0 {
+		footComment = sequence.Content[count-1].FootComment
+		sequence.Content[count-1].FootComment = ""
+	}
+
+	content := make([]*yaml.Node, 0, len(values))
+	for _, value := range values {
+		if entries := existing[value]; len(entries) != 0 {
+			content = append(content, entries[0])
+			existing[value] = entries[1:]
+			continue
+		}
+		entry := &yaml.Node{}
+		if err := entry.Encode(value); err != nil {
+			return false
+		}
+		content = append(content, entry)
+	}
+	if len(content) != 0 && content[len(content)-1].FootComment == "" {
+		content[len(content)-1].FootComment = footComment
+	}
+	sequence.Content = content
+	return true
+}
+
+// tomlTableHeader matches the header of a TOML table, which ends the top level keys
+var tomlTableHeader = regexp.MustCompile(`^\s*\[`)
+
+// splitTOMLComment splits a line of TOML into its code and any trailing comment
+func splitTOMLComment(line string) (string, string) {
+	var quote rune
+	for i, character := range line {
+		switch {
+		case quote != 0 && character == quote:
+			quote = 0
+		case quote == 0 && (character == '"' || character == '\''):
+			quote = character
+		case quote == 0 && character == '#':
+			return line[:i], line[i:]
+		}
+	}
+	return line, ""
+}
+
+// tomlBracketDepth returns the change in array nesting across a line of TOML code
+func tomlBracketDepth(code string) int {
+	depth := 0
+	var quote rune
+	for _, character := range code {
+		switch {
+		case quote != 0 && character == quote:
+			quote = 0
+		case quote == 0 && (character == '"' || character == '\''):
+			quote = character
+		case quote == 0 && character == '[':
+			depth++
+		case quote == 0 && character == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+// editTOML edits the top level keys of a TOML document line by line, so comments and
+// everything else in the document are kept as they were.
+func editTOML(data []byte, key string, value json.RawMessage) ([]byte, error) {
+	var line string
+	if value != nil {
+		encoded, err := tomlFromJSON([]byte(fmt.Sprintf("{%q:%s}", key, value)))
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(string(encoded), "\n")
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	keyPattern := regexp.MustCompile(`^\s*("` + regexp.QuoteMeta(key) + `"|` + regexp.QuoteMeta(key) + `)\s*=`)
+
+	// Find the key, and where the top level keys end, stepping over values that span lines
+	start, end, tablesStart := -1, -1, len(lines)
+	for i := 0; i < len(lines); i++ {
+		code, _ := splitTOMLComment(lines[i])
+		if tomlTableHeader.MatchString(code) {
+			tablesStart = i
+			break
+		}
+		last := i
+		for depth := tomlBracketDepth(code); depth > 0 && last+1 < len(lines); {
+			last++
+			next, _ := splitTOMLComment(lines[last])
+			depth += tomlBracketDepth(next)
+		}
+		if keyPattern.MatchString(code) {
+			start, end = i, last
+		}
+		i = last
+	}
+
+	// Lists are edited entry by entry, so the entries that remain keep their comments
+	var list []string
+	if start >= 0 && start != end && value != nil {
+		list = editTOMLList(lines[start:end+1], value)
+	}
+
+	var edited []string
+	switch {
+	case start >= 0 && value == nil:
+		edited = append(append(edited, lines[:start]...), lines[end+1:]...)
+	case list != nil:
+		edited = append(append(append(edited, lines[:start]...), list...), lines[end+1:]...)
+	case start >= 0:
+		// Keep a comment at the end of a single line value
+		if _, comment := splitTOMLComment(lines[start]); start == end && comment != "" {
+			line += " " + comment
+		}
+		edited = append(append(append(edited, lines[:start]...), line), lines[end+1:]...)
+	case value != nil:
+		insert := tablesStart
+		for insert > 0 && strings.TrimSpace(lines[insert-1]) == "" {
+			insert--
+		}
+		edited = append(append(append(edited, lines[:insert]...), line), lines[insert:]...)
+	default:
+		edited = lines
+	}
+
+	return []byte(strings.Join(edited, "\n") + "\n"), nil
+}
+
+// tomlArrayStart matches the first line of an array that puts its entries on the lines
+// below, as in "exclusions = ["
+var tomlArrayStart = regexp.MustCompile(`=\s*\[\s*$`)
+
+// tomlListEntry is an entry of a TOML array written one entry per line, along with the
+// comment lines above it
+type tomlListEntry struct {
+	value string
+	lines []string
+}
+
+// editTOMLList edits the lines of a TOML array of strings written one entry per line,
+// so that it holds the strings in value. The line of each entry that remains is kept,
+// along with its comment and the comment lines above it. It returns nil if the lines
+// are not laid out that way, or value is not a list of strings.
+func editTOMLList(lines []string, value json.RawMessage) []string {
+	var values []string
+	if json.Unmarshal(value, &values) != nil {
+		return nil
+	}
+	first, _ := splitTOMLComment(lines[0])
+	last, _ := splitTOMLComment(lines[len(lines)-1])
+	if !tomlArrayStart.MatchString(first) || strings.TrimSpace(last) != "]" {
+		return nil
+	}
+
+	var entries []tomlListEntry
+	var pending []string
+	indent := ""
+	for _, line := range lines[1 : len(lines)-1] {
+		code, _ := splitTOMLComment(line)
+		if strings.TrimSpace(code) == "" {
+			pending = append(pending, line)
+			continue
+		}
+		var decoded struct{ Entry []string }
+		literal := strings.TrimSuffix(strings.TrimSpace(code), ",")
+		if _, err := toml.Decode("entry = ["+literal+"]", &decoded); err != nil || len(decoded.Entry) != 1 {
+			return nil
+		}
+		if indent == "" {
+			indent = code[:len(code)-len(strings.TrimLeft(code, " \t"))]
+		}
+		entries = append(entries, tomlListEntry{decoded.Entry[0], append(pending, line)})
+		pending = nil
+	}
+	if indent == "" {
+		indent = "  "
+	}
+
+	edited := []string{lines[0]}
+	used := make([]bool, len(entries))
+	for _, wanted := range values {
+		found := false
+		for i, entry := range entries {
+			if !used[i] && entry.value == wanted {
+				used[i], found = true, true
+				edited = append(edited, entry.lines[:len(entry.lines)-1]...)
+				edited = append(edited, tomlEntryWithComma(entry.lines[len(entry.lines)-1]))
+				break
+			}
+		}
+		if !found {
+			quoted, _ := json.Marshal(wanted)
+			encoded, err := tomlFromJSON([]byte(fmt.Sprintf(`{"entry":%s}`, quoted)))
+			if err != nil {
+				return nil
+			}
+			literal := strings.TrimPrefix(strings.TrimSpace(string(encoded)), "entry = ")
+			edited = append(edited, indent+literal+",")
+		}
+	}
+	edited = append(edited, pending...)
+	return append(edited, lines[len(lines)-1])
+}
+
+// tomlEntryWithComma returns a line holding an entry of a TOML array with a comma
+// after the entry, ahead of any comment
+func tomlEntryWithComma(line string) string {
+	code, comment := splitTOMLComment(line)
+	trimmed := strings.TrimRight(code, " \t")
+	if strings.HasSuffix(trimmed, ",") {
+		return line
+	}
+	return trimmed + "," + code[len(trimmed):] + comment
+}
+
+// configValueFromString converts a value given on the command line to the JSON value
+// of the key. Lists may be given as comma separated values or as a JSON array.
+func configValueFromString(key, value string) (json.RawMessage, error) {
+	switch key {
+	case configKeyExclusions, configKeyMatrix, configKeyTags, configKeyFlags:
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var values []string
+			if err := json.Unmarshal([]byte(value), &values); err != nil {
+				return nil, configError{key, "expected a comma separated list or a JSON array of strings"}
+			}
+			return json.Marshal(values)
+		}
+		values := splitList(value)
+		if values == nil {
+			values = []string{}
+		}
+		return json.Marshal(values)
+	case configKeyTimeout:
+		return json.Marshal(value)
+	case configKeyEnv:
+		if strings.HasPrefix(strings.TrimSpace(value), "{") {
+			var env map[string]string
+			if err := json.Unmarshal([]byte(value), &env); err != nil {
+				return nil, configError{key, "expected comma separated KEY=VALUE pairs or a JSON object of strings"}
+			}
+			return json.Marshal(env)
+		}
+		env, err := parseEnvList(value)
+		if err != nil {
+			return nil, configError{key, err.Error()}
+		}
+		return json.Marshal(env)
+	case configKeyJobs, configKeyParallel:
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, configError{key, fmt.Sprintf("expected a positive whole number, got \"%s\"", value)}
+		}
+		return json.Marshal(count)
+	case configKeyRace, configKeyCoverage:
+		switch strings.ToLower(value) {
+		case "true", "yes":
+			return json.Marshal(true)
+		case "false", "no":
+			return json.Marshal(false)
+		}
+		return nil, configError{key, fmt.Sprintf("expected true or false, got \"%s\"", value)}
+	case configKeyProfiles, configKeyOverrides:
+		return nil, configError{key, fmt.Sprintf("%s hold several settings each, so they must be edited in the file", key)}
+	case configKeyVersion:
+		return nil, configError{key, "the version is managed by gorc and cannot be set"}
+	}
+	return nil, configError{key, fmt.Sprintf("not a recognized key; expected one of %s", strings.Join(configEditableKeys, ", "))}
+}
+
+// configEditableKeys are the keys that may be set from the command line
+var configEditableKeys = []string{configKeyCoverage, configKeyEnv, configKeyExclusions, configKeyFlags, configKeyJobs, configKeyMatrix,
+	configKeyParallel, configKeyRace, configKeyTags, configKeyTimeout}
+
+// readConfigDocument reads the configuration file at path as a JSON object, returning
+// its contents along with each top level key. A missing file is empty. A file written
+// by an older version of gorc is migrated, so an edited file is saved in the current
+// format.
+func readConfigDocument(path string) ([]byte, map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, values, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if data, _, err = migrateConfigData(path, data); err != nil {
+		return nil, nil, err
+	}
+	converted, err := decodeConfigFile(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(converted, &values); err != nil {
+		return nil, nil, fmt.Errorf("the file does not hold a configuration object: %s", err)
+	}
+	return data, values, nil
+}
+
+// editConfigKey sets, or removes if value is nil, a key of the configuration file at
+// path. See updateConfigKey.
+func editConfigKey(path, key string, value json.RawMessage) (removed bool, err error) {
+	return updateConfigKey(path, key, func(json.RawMessage) (json.RawMessage, error) {
+		return value, nil
+	})
+}
+
+// updateConfigKey replaces a key of the configuration file at path with the value
+// returned by update, which is given the current value, or nil if the key is not set.
+// A nil value removes the key. The file is read, edited and written while holding
+// the configuration lock, so concurrent updates are not lost. The edited file is
+// validated before it atomically replaces the original, and everything else in the
+// file, including comments and keys gorc does not recognize, is kept as it was. If
+// the file is left without any settings, it is removed and removed is true.
+func updateConfigKey(path, key string, update func(current json.RawMessage) (json.RawMessage, error)) (removed bool, err error) {
+	unlock, err := lockConfigFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	data, values, err := readConfigDocument(path)
+	if err != nil {
+		return false, err
+	}
+	value, err := update(values[key])
+	if err != nil {
+		return false, err
+	}
+
+	edit := formatForPath(path).edit
+	if _, ok := values[configKeyVersion]; !ok && value != nil {
+		if data, err = edit(data, configKeyVersion, json.RawMessage(fmt.Sprint(currentConfigVersion))); err != nil {
+			return false, err
+		}
+	}
+	if data, err = edit(data, key, value); err != nil {
+		return false, err
+	}
+
+	config, _, errs := parseConfigFile(path, data)
+	if len(errs) != 0 {
+		return false, errs[0]
+	}
+	if config.empty() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return len(values) != 0, nil
+	}
+	return false, writeFileAtomic(path, data)
+}
+
+// formatConfigValue returns a configuration value for printing. Lists are printed one
+// entry per line, and strings without quotes.
+func formatConfigValue(value json.RawMessage) string {
+	var text string
+	if json.Unmarshal(value, &text) == nil {
+		return text
+	}
+	var list []string
+	if json.Unmarshal(value, &list) == nil {
+		return strings.Join(list, "\n")
+	}
+	return string(value)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const commentedYAML = `# Directories gorc does not test
+exclusions:
+  # generated code
+  - mocks # generated by mockery
+  - legacy # to be deleted
+  # keep this list short
+timeout: 10s
+`
+
+const commentedTOML = `# Directories gorc does not test
+exclusions = [
+  # generated code
+  "mocks", # generated by mockery
+  "legacy" # to be deleted
+  # keep this list short
+]
+timeout = "10s"
+`
+
+func TestEditCommentedLists(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  documentEditor
+		data  string
+		value string
+		want  string
+	}{
+		{
+			name:  "yaml append",
+			edit:  editYAML,
+			data:  commentedYAML,
+			value: `["mocks","legacy","vendor"]`,
+			want: `# Directories gorc does not test
+exclusions:
+  # generated code
+  - mocks # generated by mockery
+  - legacy # to be deleted
+  - vendor
+  # keep this list short
+timeout: 10s
+`,
+		},
+		{
+			name:  "yaml remove last",
+			edit:  editYAML,
+			data:  commentedYAML,
+			value: `["mocks"]`,
+			want: `# Directories gorc does not test
+exclusions:
+  # generated code
+  - mocks # generated by mockery
+  # keep this list short
+timeout: 10s
+`,
+		},
+		{
+			name:  "yaml remove first",
+			edit:  editYAML,
+			data:  commentedYAML,
+			value: `["legacy"]`,
+			want: `# Directories gorc does not test
+exclusions:
+  - legacy # to be deleted
+  # keep this list short
+timeout: 10s
+`,
+		},
+		{
+			name:  "toml append",
+			edit:  editTOML,
+			data:  commentedTOML,
+			value: `["mocks","legacy","vendor"]`,
+			want: `# Directories gorc does not test
+exclusions = [
+  # generated code
+  "mocks", # generated by mockery
+  "legacy", # to be deleted
+  "vendor",
+  # keep this list short
+]
+timeout = "10s"
+`,
+		},
+		{
+			name:  "toml remove first",
+			edit:  editTOML,
+			data:  commentedTOML,
+			value: `["legacy"]`,
+			want: `# Directories gorc does not test
+exclusions = [
+  "legacy", # to be deleted
+  # keep this list short
+]
+timeout = "10s"
+`,
+		},
+		{
+			name:  "toml reorder",
+			edit:  editTOML,
+			data:  commentedTOML,
+			value: `["legacy","mocks"]`,
+			want: `# Directories gorc does not test
+exclusions = [
+  "legacy", # to be deleted
+  # generated code
+  "mocks", # generated by mockery
+  # keep this list short
+]
+timeout = "10s"
+`,
+		},
+		{
+			name:  "toml single line",
+			edit:  editTOML,
+			data:  "exclusions = [\"mocks\"] # generated\n",
+			value: `["mocks","vendor"]`,
+			want:  "exclusions = [\"mocks\", \"vendor\"] # generated\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			edited, err := test.edit([]byte(test.data), configKeyExclusions, json.RawMessage(test.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(edited) != test.want {
+				t.Errorf("got\n%s\nwant\n%s", edited, test.want)
+			}
+		})
+	}
+}
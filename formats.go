@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFormat is a file format a configuration file may be written in. Every format
+// is converted to and from JSON, so all of them share the same schema and validation.
+type configFormat struct {
+	name       string
+	extensions []string
+	toJSON     func(data []byte) ([]byte, error)
+	fromJSON   func(data []byte) ([]byte, error)
+	edit       documentEditor
+}
+
+// configFormats are the supported formats, in order of precedence. If a directory holds
+// configuration files in more than one format, only the first is used.
+var configFormats = []configFormat{
+	{"json", []string{""}, unchangedJSON, unchangedJSON, editJSON},
+	{"yaml", []string{".yaml", ".yml"}, yamlToJSON, yamlFromJSON, editYAML},
+	{"toml", []string{".toml"}, tomlToJSON, tomlFromJSON, editTOML},
+}
+
+// unchangedJSON returns JSON data unchanged
+func unchangedJSON(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// yamlToJSON converts a YAML document to JSON
+func yamlToJSON(data []byte) ([]byte, error) {
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	return json.Marshal(values)
+}
+
+// yamlFromJSON converts a JSON object to a YAML document
+func yamlFromJSON(data []byte) ([]byte, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(values)
+}
+
+// tomlToJSON converts a TOML document to JSON
+func tomlToJSON(data []byte) ([]byte, error) {
+	var values map[string]interface{}
+	if err := toml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return json.Marshal(values)
+}
+
+// tomlFromJSON converts a JSON object to a TOML document
+func tomlFromJSON(data []byte) ([]byte, error) {
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	// TOML has no type for arbitrary JSON numbers, so store whole numbers as integers
+	convertJSONNumbers(values)
+
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(values); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// convertJSONNumbers replaces the json.Number values in a decoded JSON value with
+// int64 or float64 values, in place.
+func convertJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if integer, err := v.Int64(); err == nil {
+			return integer
+		}
+		float, _ := v.Float64()
+		return float
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = convertJSONNumbers(element)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = convertJSONNumbers(element)
+		}
+	}
+	return value
+}
+
+// formatNamed returns the format with the given name
+func formatNamed(name string) (configFormat, bool) {
+	for _, format := range configFormats {
+		if format.name == strings.ToLower(name) {
+			return format, true
+		}
+	}
+	return configFormat{}, false
+}
+
+// formatForPath returns the format of the configuration file at path, judged by its
+// extension. Files with no recognized extension are JSON.
+func formatForPath(path string) configFormat {
+	extension := strings.ToLower(filepath.Ext(path))
+	for _, format := range configFormats[1:] {
+		if contains, _ := sliceContainsString(extension, format.extensions); contains {
+			return format
+		}
+	}
+	return configFormats[0]
+}
+
+// configBasePath returns the path of a configuration file without its format extension
+func configBasePath(path string) string {
+	if formatForPath(path).name == configFormats[0].name {
+		return path
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+// configFileNames returns the file names a configuration file with the base name may
+// have, in order of precedence.
+func configFileNames(base string) []string {
+	var names []string
+	for _, format := range configFormats {
+		for _, extension := range format.extensions {
+			names = append(names, base+extension)
+		}
+	}
+	return names
+}
+
+// configFilesIn returns the paths of the configuration files with the base name in
+// directory, in order of precedence.
+func configFilesIn(directory, base string) []string {
+	var paths []string
+	for _, name := range configFileNames(base) {
+		path := filepath.Join(directory, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// configFileIn returns the path of the configuration file with the base name in
+// directory that takes precedence, or an empty string if there is none.
+func configFileIn(directory, base string) string {
+	if paths := configFilesIn(directory, base); len(paths) != 0 {
+		return paths[0]
+	}
+	return ""
+}
+
+// decodeConfigFile converts the contents of the configuration file at path to JSON
+func decodeConfigFile(path string, data []byte) ([]byte, error) {
+	format := formatForPath(path)
+	converted, err := format.toJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("the file is not valid %s: %s", strings.ToUpper(format.name), err)
+	}
+	return converted, nil
+}
+
+// encodeConfigFile converts JSON configuration data to the format of the file at path
+func encodeConfigFile(path string, data []byte) ([]byte, error) {
+	return formatForPath(path).fromJSON(data)
+}
+
+// convertConfig rewrites the configuration file at path in the named format, removing
+// the original, and returns the path of the new file. A file already holding the
+// configuration in that format is only replaced if force is true.
+func convertConfig(path, formatName string, force bool) (string, error) {
+	format, ok := formatNamed(formatName)
+	if !ok {
+		return "", fmt.Errorf(errorUnknownFormat, formatName)
+	}
+	if !fileExists(path) {
+		return "", fmt.Errorf("there is no configuration file to convert")
+	}
+
+	target := configBasePath(path) + format.extensions[0]
+	if target == path {
+		return path, nil
+	}
+	if fileExists(target) && !force {
+		return "", fmt.Errorf(errorConvertTargetExists, target)
+	}
+
+	unlock, err := lockConfigFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	config, _, errs := parseConfigFile(path, data)
+	if len(errs) != 0 {
+		return "", errs[0]
+	}
+	if err := writeConfigFile(target, config); err != nil {
+		return "", err
+	}
+	if err := os.Remove(path); err != nil {
+		return "", err
+	}
+	return target, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hashFile returns the hex encoded SHA-256 of the contents of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFiles returns the content hash of the files in or below root that gorc would
+// walk, keyed by path relative to root. In a git repository these are the files git
+// tracks, along with untracked files it does not ignore; otherwise every regular file
+// is hashed. Files in excluded or ignored directories are left out. Directories and
+// files that cannot be read are skipped and returned as errors.
+func hashFiles(root string) (map[string]string, []error) {
+	files, errs := listFiles(root)
+	ignores := newIgnoreMatcher(root)
+	skipped := map[string]bool{root: false}
+	var skip func(directory string) bool
+	skip = func(directory string) bool {
+		if result, ok := skipped[directory]; ok {
+			return result
+		}
+		result := skip(filepath.Dir(directory)) || configs.excluded(directory) || (!noIgnore && ignores.ignored(directory))
+		skipped[directory] = result
+		return result
+	}
+
+	hashes := make(map[string]string)
+	for _, relative := range files {
+		path := filepath.Join(root, relative)
+		if skip(filepath.Dir(path)) {
+			continue
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			// Tracked files that have been deleted are simply absent
+			if !os.IsNotExist(err) {
+				errs = append(errs, walkError{path, err})
+			}
+			continue
+		}
+		hashes[relative] = hash
+	}
+	return hashes, errs
+}
+
+// listFiles returns the paths, relative to root, of the files to hash. git is asked
+// for them first, and the tree is walked if root is not in a git repository.
+func listFiles(root string) ([]string, []error) {
+	output, err := runShellCommand(root, "git", "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	if err == nil {
+		var files []string
+		for _, file := range strings.Split(output, "\x00") {
+			if file != "" {
+				files = append(files, filepath.FromSlash(file))
+			}
+		}
+		return files, nil
+	}
+
+	var files []string
+	var errs []error
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, walkError{path, err})
+			return nil
+		}
+		if entry.IsDir() {
+			if entry.Name() == gitDirectory {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if relative, err := filepath.Rel(root, path); err == nil {
+				files = append(files, relative)
+			}
+		}
+		return nil
+	})
+	return files, errs
+}
+
+// changedFiles returns the sorted paths that were added, removed or modified
+// between two sets of file hashes.
+func changedFiles(before, after map[string]string) []string {
+	var changed []string
+	for path, hash := range after {
+		if previous, ok := before[path]; !ok || previous != hash {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// generatePackages runs go generate in every package in or below the current working
+// directory. In check mode it fails if generation changed any file, listing the
+// files that drifted from what was there before.
+func generatePackages(name string, check, verbose bool) bool {
+	directory, err := getwd()
+	if err != nil {
+		return false
+	}
+
+	var before map[string]string
+	if check {
+		var errs []error
+		before, errs = hashFiles(directory)
+		recordWalkErrors(errs)
+	}
+
+	fmt.Print("\nGenerating packages: ")
+	outputs := runJobs(newJobs(findDirectories(name, searchGo), goCommand, "generate"))
+	run, failed := len(outputs), countAndPrintOutputs(outputs, verbose)
+	printSummary("packages", "generated", run, failed)
+	if run == 0 {
+		return true
+	}
+
+	if !check {
+		return failed == 0
+	}
+
+	after, errs := hashFiles(directory)
+	recordWalkErrors(errs)
+	drifted := changedFiles(before, after)
+	if len(drifted) != 0 {
+		fmt.Printf("Generated files are out of date:\n\t%s\n\n", strings.Join(drifted, "\n\t"))
+		return false
+	}
+	fmt.Print("Generated files are up to date.\n\n")
+
+	return failed == 0
+}
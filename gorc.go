@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/commander"
 	"github.com/stretchr/objx"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,6 +20,9 @@ const (
 
 	// searchGo is the string for searching for go files
 	searchGo = ".go"
+
+	// profileEnvironment is the environment variable that selects a profile when no profile argument is given
+	profileEnvironment = "GORC_PROFILE"
 )
 
 func getwd() (string, error) {
@@ -26,34 +33,103 @@ func getwd() (string, error) {
 	return directory, error
 }
 
-func addTimeoutArg(args []string) []string {
-	if timeout != "" {
+func addTimeoutArg(directory string, args []string) []string {
+	if timeout := configs.settingsFor(directory).Timeout; timeout != "" {
 		timeoutOpt := fmt.Sprintf("-timeout=%s", timeout)
 		args = append(args, timeoutOpt)
 	}
 	return args
 }
 
+// addTestSettingsArgs adds -race and -cover to the arguments if they are enabled for
+// directory and not already present, followed by the -parallel value and extra flags
+// configured for directory.
+func addTestSettingsArgs(directory string, args []string) []string {
+	settings := configs.settingsFor(directory)
+	if enabled(settings.Race) {
+		if race, _ := sliceContainsString("-race", args); !race {
+			args = append(args, "-race")
+		}
+	}
+	if enabled(settings.Coverage) {
+		covered := false
+		for _, arg := range args {
+			covered = covered || strings.HasPrefix(arg, "-cover")
+		}
+		if !covered {
+			args = append(args, "-cover")
+		}
+	}
+	if settings.Parallel > 0 {
+		args = append(args, fmt.Sprintf("-parallel=%d", settings.Parallel))
+	}
+	return append(args, settings.Flags...)
+}
+
+// installTests builds the tests in every directory containing them before they are
+// run, so that packages failing to compile are reported once and the test run can
+// use the build cache. Releases of go without a build cache install the dependencies
+// of the tests with go test -i instead.
 func installTests(name string) bool {
-	fmt.Print("\nInstalling tests: ")
-	run, failed := runCommand(false, name, searchTest, "go", "test", "-i")
+	if skipBuild {
+		return true
+	}
+
+	fmt.Print("\nBuilding tests: ")
+	outputs := buildTests(name, activeRelease())
+	defer printWalkWarnings()
+	run, failed := len(outputs), countAndPrintOutputs(outputs, false)
+	skipped := skippedJobs
+	skippedJobs = 0
 	if run == 0 && failed == 0 {
 		fmt.Println("No tests were found in or below the current working directory.")
 		return false
-	} else {
-		fmt.Printf("\n\n%d installed. %d failed. [%.0f%% success]\n\n", run-failed, failed, (float32((run-failed))/float32(run))*100)
 	}
-	return failed == 0
+	skippedCount := ""
+	if skipped != 0 {
+		skippedCount = fmt.Sprintf(" %d skipped.", skipped)
+	}
+	fmt.Printf("\n\n%d built. %d failed.%s [%.0f%% success]\n\n", run-failed-skipped, failed, skippedCount, successRate(run-failed-skipped, failed))
+	if failed != 0 {
+		fmt.Println("The tests failed to build in:")
+		for _, output := range outputs {
+			if output.err != nil && !jobSkipped(output) {
+				fmt.Printf("\t%s\n", relativePath(output.directory))
+			}
+		}
+		fmt.Println()
+	}
+	return failed == 0 && skipped == 0
+}
+
+// buildTests builds the tests in every directory selected by name, returning the
+// output of each build. With ordered runs, tests importing a package that failed to
+// build are skipped.
+func buildTests(name string, release goRelease) []cmdOutput {
+	jobs := newJobs(findDirectories(name, searchTest), goCommand, "test")
+	for i := range jobs {
+		args := append([]string{}, jobs[i].args...)
+		if release.hasBuildCache() {
+			// Build with the settings the tests will run with, so the build is reused
+			jobs[i].args = append(addTestSettingsArgs(jobs[i].directory, args), "-run=^$")
+		} else {
+			jobs[i].args = append(args, "-i")
+		}
+	}
+
+	switch {
+	case !release.hasBuildCache():
+		return runJobs(jobs)
+	case batchRun && release.atLeast(1, 10):
+		return runJobsBatched(jobs)
+	}
+	return runJobsInOrder(jobs)
 }
 
 func runTests(name string, verbose bool) bool {
 	fmt.Print("Running tests: ")
-	run, failed := runCommandParallel(verbose, false, name, searchTest, "go", "test")
-	if run == 0 && failed == 0 {
-		fmt.Println("No tests were found in or below the current working directory.")
-	} else {
-		fmt.Printf("\n\n%d run. %d succeeded. %d failed. [%.0f%% success]\n\n", run, run-failed, failed, (float32((run-failed))/float32(run))*100)
-	}
+	run, failed := runTestCommand(verbose, name, "test")
+	printSummary("tests", "run", run, failed)
 	return failed == 0
 }
 
@@ -61,23 +137,22 @@ func runCover(name, out, viewer string, coverArgs []string) bool {
 	fmt.Print("Generating test coverage: ")
 	coverCmd := []string{"test"}
 	if out != "" {
+		// Each package writes its profile in its own directory, where the viewer
+		// reads it, whereas a batched run would write one profile for the module
+		batched := batchRun
+		batchRun = false
+		defer func() { batchRun = batched }()
 		coverCmd = append(coverCmd, "-coverprofile", out)
-		coverCmd = addTimeoutArg(coverCmd)
 	} else {
 		coverCmd = append(coverCmd, "-cover")
-		coverCmd = addTimeoutArg(coverCmd)
 		coverCmd = append(coverCmd, coverArgs...)
 	}
-	run, failed := runCommandParallel(false, false, name, searchTest, "go", coverCmd...)
-	if run == 0 && failed == 0 {
-		fmt.Println("No tests were found in or below the current working directory.")
-	} else {
-		fmt.Printf("\n\n%d run. %d succeeded. %d failed. [%.0f%% success]\n\n", run, run-failed, failed, (float32((run-failed))/float32(run))*100)
-		if failed == 0 && out != "" && viewer != "" {
-			viewOpt := fmt.Sprintf("-%s=%s", viewer, out)
-			viewArgs := append([]string{"tool", "cover", viewOpt}, coverArgs...)
-			runCommandParallel(true, false, name, searchTest, "go", viewArgs...)
-		}
+	run, failed := runTestCommand(false, name, coverCmd...)
+	printSummary("tests", "run", run, failed)
+	if failed == 0 && out != "" && viewer != "" {
+		viewOpt := fmt.Sprintf("-%s=%s", viewer, out)
+		viewArgs := append([]string{"tool", "cover", viewOpt}, coverArgs...)
+		runCommandParallel(true, false, name, searchTest, goCommand, viewArgs...)
 	}
 	return failed == 0
 }
@@ -85,38 +160,78 @@ func runCover(name, out, viewer string, coverArgs []string) bool {
 func lintPackages(name string, verbose bool) bool {
 	fmt.Printf("\nRunning linter: ")
 	run, failed := runCommandParallel(verbose, true, name, searchGo, "golint")
-	if run == 0 && failed == 0 {
-		fmt.Println("No packages were found in or below the current working directory.")
-	} else {
-		fmt.Printf("\n\n%d linted. %d succeeded. %d failed. [%.0f%% success]\n\n", run, run-failed, failed, (float32((run-failed))/float32(run))*100)
-	}
+	printSummary("packages", "linted", run, failed)
 	return failed == 0
 }
 
-func vetPackages(name string, verbose bool) bool {
-	fmt.Printf("\nVetting packages: ")
-	run, failed := runCommandParallel(verbose, false, name, searchGo, "go", "vet")
-	if run == 0 && failed == 0 {
-		fmt.Println("No packages were found in or below the current working directory.")
-	} else {
-		fmt.Printf("\n\n%d vetted. %d succeeded. %d failed. [%.0f%% success]\n\n", run, run-failed, failed, (float32((run-failed))/float32(run))*100)
+func vetPackages(name string, verbose, useMatrix bool) bool {
+	if useMatrix {
+		fmt.Printf("\nVetting packages. ")
+		return runMatrix(verbose, findDirectories(name, searchGo), goCommand, "vet")
 	}
+	fmt.Printf("\nVetting packages: ")
+	run, failed := runCommandParallel(verbose, false, name, searchGo, goCommand, "vet")
+	printSummary("packages", "vetted", run, failed)
 	return failed == 0
 }
 
-func raceTests(name string) {
+func raceTests(name string) bool {
 	fmt.Printf("\nRunning race tests: ")
-	run, failed := runCommandParallel(false, false, name, searchTest, "go", "test", "-race")
-	if run == 0 && failed == 0 {
-		fmt.Println("No tests were found in or below the current working directory.")
-	} else {
-		fmt.Printf("\n\n%d run. %d succeeded. %d failed. [%.0f%% success]\n\n", run, run-failed, failed, (float32((run-failed))/float32(run))*100)
-	}
+	run, failed := runTestCommand(false, name, "test", "-race")
+	printSummary("tests", "run", run, failed)
+	return failed == 0
 }
 
 type cmdOutput struct {
-	output string
-	err    error
+	directory string
+	output    string
+	err       error
+}
+
+// job is a single command to be run in a directory
+type job struct {
+	directory string
+	command   string
+	args      []string
+	env       []string
+}
+
+// skippedJobs counts the jobs skipped rather than run since the last summary was
+// printed, so they are reported apart from the jobs that failed
+var skippedJobs int
+
+// jobSkipped determines if the output of a job records that it was skipped, because a
+// dependency failed or because build constraints exclude its package
+func jobSkipped(output cmdOutput) bool {
+	return output.err == errDependencyFailed || output.err == errExcludedByConstraints
+}
+
+// successRate returns the percentage of the items that were not skipped which
+// succeeded, which is 100 if every item was skipped
+func successRate(succeeded, failed int) float32 {
+	if succeeded+failed == 0 {
+		return 100
+	}
+	return (float32(succeeded) / float32(succeeded+failed)) * 100
+}
+
+// printSummary prints how many items were run and how many of them succeeded, failed
+// and were skipped, or that none were found, followed by any directories that could
+// not be read while looking for them. The failed count leaves out skipped items.
+func printSummary(items, verb string, run, failed int) {
+	skipped := skippedJobs
+	skippedJobs = 0
+	if run == 0 && failed == 0 {
+		fmt.Printf("No %s were found in or below the current working directory.\n", items)
+	} else {
+		succeeded := run - failed - skipped
+		skippedCount := ""
+		if skipped != 0 {
+			skippedCount = fmt.Sprintf(" %d skipped.", skipped)
+		}
+		fmt.Printf("\n\n%d %s. %d succeeded. %d failed.%s [%.0f%% success]\n\n", run, verb, succeeded, failed, skippedCount, successRate(succeeded, failed))
+	}
+	printWalkWarnings()
 }
 
 func countAndPrintOutputs(outputs []cmdOutput, verbose bool) int {
@@ -127,7 +242,9 @@ func countAndPrintOutputs(outputs []cmdOutput, verbose bool) int {
 			if results != "" && (verbose || output.err != nil) {
 				fmt.Printf("\n\n%s", results)
 			}
-			if output.err != nil {
+			if jobSkipped(output) {
+				skippedJobs++
+			} else if output.err != nil {
 				errCount++
 			}
 		}
@@ -136,119 +253,170 @@ func countAndPrintOutputs(outputs []cmdOutput, verbose bool) int {
 	return 0
 }
 
-func runCommand(verbose bool, target, search, command string, args ...string) (int, int) {
-	var outputs []cmdOutput
-	lastPrintLen := 0
-	currentJob := 1
-	directories := []string{}
-
-	if directory, error := getwd(); error == nil {
-		recurseDirectories(directory, target, search,
-			func(currentDirectory string) bool {
-				if target == "all" {
-					return false
-				}
-				if contains, _ := sliceContainsString(currentDirectory, exclusions); target == "" && contains {
-					return true
-				}
-				return false
-			},
-			func(currentDirectory string) {
-				directories = append(directories, currentDirectory)
-			})
+// printProgress prints the "[current of total]" progress indicator, erasing the
+// previously printed indicator, and returns the length to erase next time.
+func printProgress(lastPrintLen, current, total int) int {
+	if lastPrintLen == 0 {
+		printString := fmt.Sprintf("[%d of %d]", current, total)
+		fmt.Print(printString)
+		return len(printString)
 	}
+	printString := fmt.Sprintf("%s[%d of %d]", strings.Repeat("\b", lastPrintLen), current, total)
+	fmt.Print(printString)
+	return len(printString) - lastPrintLen
+}
 
-	numCommands := len(directories)
+// findDirectories returns every directory in or below the current working directory
+// that contains a file matching search, honoring the target, the exclusion list and
+// any .gitignore or .gorcignore files.
+// In a go workspace, each module used by the workspace is searched instead, and
+// modules that are not part of the workspace are skipped.
+// The target is resolved once for each search, and the same directories are returned
+// to every command that asks again.
+func findDirectories(target, search string) []string {
+	key := target + "\x00" + search
+	if directories, ok := packageSets[key]; ok {
+		return directories
+	}
 
-	for _, directory := range directories {
-		if lastPrintLen == 0 {
-			printString := fmt.Sprintf("[%d of %d]", currentJob, numCommands)
-			lastPrintLen = len(printString)
-			fmt.Print(printString)
-		} else {
-			printString := fmt.Sprintf("%s[%d of %d]", strings.Repeat("\b", lastPrintLen), currentJob, numCommands)
-			lastPrintLen = len(printString) - lastPrintLen
-			fmt.Print(printString)
+	directories := []string{}
+	statuses, errs := discoverDirectories(target, search)
+	recordWalkErrors(errs)
+	for _, status := range statuses {
+		if status.Status == statusSelected {
+			directories = append(directories, status.directory)
 		}
+	}
 
-		currentJob++
+	packageSets[key] = directories
+	return directories
+}
 
-		output, err := runShellCommand(directory, command, args...)
+// useWorkspace switches gorc to workspace mode if there is a go.work file in the
+// current working directory, so the go commands it runs see the same workspace.
+func useWorkspace() {
+	directory, error := getwd()
+	if error != nil {
+		return
+	}
+	path, modules, error := readWorkspace(directory)
+	if error != nil {
+		fmt.Printf(errorReadingWorkspace, error)
+		os.Exit(1)
+	}
+	if path != "" {
+		workspaceModules = modules
+		if workspaceModules == nil {
+			workspaceModules = []string{}
+		}
+		commandEnvironment = append(commandEnvironment, "GOWORK="+path)
+	}
+}
 
-		outputs = append(outputs, cmdOutput{output, err})
+// taggedGoCommands are the go subcommands that accept the -tags flag
+var taggedGoCommands = []string{"build", "generate", "install", "test", "vet"}
+
+// newJobs creates a job running the command in each of the directories, with the
+// environment variables configured for each directory. Go commands that accept build
+// tags are given the tags configured for each directory.
+func newJobs(directories []string, command string, args ...string) []job {
+	jobs := make([]job, len(directories))
+	for i, directory := range directories {
+		jobs[i] = job{directory: directory, command: command, args: addTagsArg(directory, command, args),
+			env: environment(configs.settingsFor(directory).Env)}
 	}
+	return jobs
+}
 
-	return currentJob - 1, countAndPrintOutputs(outputs, verbose)
+// addTagsArg inserts the build tags configured for directory after the go subcommand
+func addTagsArg(directory, command string, args []string) []string {
+	if command != goCommand || len(args) == 0 {
+		return args
+	}
+	if tagged, _ := sliceContainsString(args[0], taggedGoCommands); !tagged {
+		return args
+	}
+	tags := configs.settingsFor(directory).Tags
+	if len(tags) == 0 {
+		return args
+	}
+	tagged := []string{args[0], "-tags=" + strings.Join(tags, ",")}
+	return append(tagged, args[1:]...)
 }
 
-func runCommandParallel(verbose, glob bool, target, search, command string, args ...string) (int, int) {
+// runJobs runs each job in turn, printing progress as it goes
+func runJobs(jobs []job) []cmdOutput {
 	var outputs []cmdOutput
 	lastPrintLen := 0
+
+	for i, j := range jobs {
+		lastPrintLen = printProgress(lastPrintLen, i+1, len(jobs))
+		output, err := runShellCommandEnv(j.directory, j.env, j.command, j.args...)
+		outputs = append(outputs, cmdOutput{j.directory, output, err})
+	}
+
+	return outputs
+}
+
+// runJobsParallel runs all of the jobs concurrently, printing progress as they complete.
+// The outputs are returned in the same order as the jobs.
+func runJobsParallel(jobs []job) []cmdOutput {
+	return runParallel(len(jobs), func(index int) cmdOutput {
+		j := jobs[index]
+		out, err := runShellCommandEnv(j.directory, j.env, j.command, j.args...)
+		return cmdOutput{j.directory, out, err}
+	})
+}
+
+// runParallel calls work concurrently for each index below count, printing progress
+// as each call completes. No more than the configured number of jobs run at once.
+// The outputs are returned in index order.
+func runParallel(count int, work func(index int) cmdOutput) []cmdOutput {
+	return runParallelAfter(count, nil, work)
+}
+
+// runParallelAfter is runParallel, except that wait, if it is not nil, is called for
+// each index before work is, without counting towards the number of jobs running.
+func runParallelAfter(count int, wait func(index int), work func(index int) cmdOutput) []cmdOutput {
+	outputs := make([]cmdOutput, count)
+	lastPrintLen := 0
 	currentJob := 1
-	directories := []string{}
 
-	if directory, error := getwd(); error == nil {
-		recurseDirectories(directory, target, search,
-			func(currentDirectory string) bool {
-				if target == "all" {
-					return false
-				}
-				if contains, _ := sliceContainsString(currentDirectory, exclusions); target == "" && contains {
-					return true
-				}
-				return false
-			},
-			func(currentDirectory string) {
-				directories = append(directories, currentDirectory)
-			})
+	type indexedOutput struct {
+		index  int
+		output cmdOutput
 	}
 
-	numCommands := len(directories)
-	outputChan := make(chan cmdOutput, 10)
+	outputChan := make(chan indexedOutput, 10)
 	var wg sync.WaitGroup
-	wg.Add(numCommands)
-
-	for _, directory := range directories {
-		go func(dir string) {
-			shellArgs := make([]string, len(args))
-			copy(shellArgs, args)
-			if glob {
-				pattern := fmt.Sprintf("%s/*%s", dir, search)
-				files, err := filepath.Glob(pattern)
-				if err == nil {
-					shellArgs = append(shellArgs, files...)
-				}
-			}
-			out, err := runShellCommand(dir, command, shellArgs...)
-			outputChan <- cmdOutput{out, err}
-		}(directory)
+	wg.Add(count)
+
+	var slots chan struct{}
+	if maxJobs > 0 {
+		slots = make(chan struct{}, maxJobs)
 	}
 
-	if lastPrintLen == 0 {
-		printString := fmt.Sprintf("[%d of %d]", currentJob, numCommands)
-		lastPrintLen = len(printString)
-		fmt.Print(printString)
-	} else {
-		printString := fmt.Sprintf("%s[%d of %d]", strings.Repeat("\b", lastPrintLen), currentJob, numCommands)
-		lastPrintLen = len(printString) - lastPrintLen
-		fmt.Print(printString)
+	for i := 0; i < count; i++ {
+		go func(index int) {
+			if wait != nil {
+				wait(index)
+			}
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+			outputChan <- indexedOutput{index, work(index)}
+		}(i)
 	}
 
+	lastPrintLen = printProgress(lastPrintLen, currentJob, count)
+
 	go func() {
 		for output := range outputChan {
-
-			if lastPrintLen == 0 {
-				printString := fmt.Sprintf("[%d of %d]", currentJob, numCommands)
-				lastPrintLen = len(printString)
-				fmt.Print(printString)
-			} else {
-				printString := fmt.Sprintf("%s[%d of %d]", strings.Repeat("\b", lastPrintLen), currentJob, numCommands)
-				lastPrintLen = len(printString) - lastPrintLen
-				fmt.Print(printString)
-			}
+			lastPrintLen = printProgress(lastPrintLen, currentJob, count)
 			currentJob++
 
-			outputs = append(outputs, output)
+			outputs[output.index] = output.output
 
 			wg.Done()
 		}
@@ -256,7 +424,41 @@ func runCommandParallel(verbose, glob bool, target, search, command string, args
 
 	wg.Wait()
 
-	return currentJob - 1, countAndPrintOutputs(outputs, verbose)
+	return outputs
+}
+
+// runTestCommand runs go with the arguments in every directory containing tests, adding
+// the timeout, race detection and coverage configured for each directory, followed by
+// the test flags given as arguments.
+func runTestCommand(verbose bool, target string, args ...string) (int, int) {
+	jobs := newJobs(findDirectories(target, searchTest), goCommand, args...)
+	for i := range jobs {
+		jobs[i].args = addTestSettingsArgs(jobs[i].directory, addTimeoutArg(jobs[i].directory, append([]string{}, jobs[i].args...)))
+		jobs[i].args = append(jobs[i].args, testFlags...)
+	}
+	var outputs []cmdOutput
+	// go test -json arrived with go1.10
+	if batchRun && activeRelease().atLeast(1, 10) {
+		outputs = runJobsBatched(jobs)
+	} else {
+		outputs = runJobsInOrder(jobs)
+	}
+	return len(outputs), countAndPrintOutputs(outputs, verbose)
+}
+
+func runCommandParallel(verbose, glob bool, target, search, command string, args ...string) (int, int) {
+	jobs := newJobs(findDirectories(target, search), command, args...)
+	if glob {
+		for i := range jobs {
+			pattern := fmt.Sprintf("%s/*%s", jobs[i].directory, search)
+			files, err := filepath.Glob(pattern)
+			if err == nil {
+				jobs[i].args = append(append([]string{}, jobs[i].args...), files...)
+			}
+		}
+	}
+	outputs := runJobsInOrder(jobs)
+	return len(outputs), countAndPrintOutputs(outputs, verbose)
 }
 
 func parseBoolArg(args objx.Map, name string) bool {
@@ -269,57 +471,205 @@ func parseBoolArg(args objx.Map, name string) bool {
 	return false
 }
 
+// reportConfigEdit reports the outcome of editing the project configuration file,
+// exiting if the edit failed
+func reportConfigEdit(removed bool, err error) {
+	if err != nil {
+		fmt.Printf("\n%s\n\t%s\n\n", errorSavingFile, err)
+		os.Exit(1)
+	}
+	if removed {
+		fmt.Printf("\nRemoved %s as it no longer holds any settings.\n", configPath)
+	}
+}
+
+// prepareWalk applies the walk arguments and prints the run header for the go
+// subcommand that will be run, which is empty if the command does not run go
+func prepareWalk(args objx.Map, subcommand string) {
+	applyWalkArgs(args)
+	directory, _ := getwd()
+	tagged, _ := sliceContainsString(subcommand, taggedGoCommands)
+	printRunHeader(configs.settingsFor(directory), tagged)
+}
+
+// applyWalkArgs selects the profile, loads the configuration and applies the arguments
+// that control how directories are walked
+func applyWalkArgs(args objx.Map) {
+	profile = parseStringArg(args, "profile")
+	if profile == "" {
+		profile = os.Getenv(profileEnvironment)
+	}
+	commandLine = &configuration{Tags: splitList(parseStringArg(args, "tags"))}
+	env, err := parseEnvList(parseStringArg(args, "env"))
+	if err != nil {
+		fmt.Printf("\n%s\n\n", err)
+		os.Exit(1)
+	}
+	commandLine.Env = env
+	loadConfig()
+	directory, _ := getwd()
+	if profile != "" && !configs.definesProfile(directory, profile) {
+		fmt.Printf(errorUnknownProfile, profile)
+		os.Exit(1)
+	}
+	noIgnore = parseBoolArg(args, "noignore")
+	strictWalk = parseBoolArg(args, "strict")
+	followSymlinks = parseBoolArg(args, "symlinks")
+	orderedRun = parseBoolArg(args, "ordered")
+	toolchains = splitList(parseStringArg(args, "go"))
+}
+
+// printRunHeader prints the profile, build tags and environment variables the go
+// commands will be run with, so it is clear what configuration produced the results.
+// The build tags are only printed if the commands are tagged, as others ignore them.
+func printRunHeader(settings *configuration, tagged bool) {
+	var lines []string
+	if profile != "" {
+		lines = append(lines, fmt.Sprintf("Profile: %s", profile))
+	}
+	if tagged && len(settings.Tags) != 0 {
+		lines = append(lines, fmt.Sprintf("Tags: %s", strings.Join(settings.Tags, ",")))
+	}
+	if env := environment(settings.Env); len(env) != 0 {
+		lines = append(lines, fmt.Sprintf("Environment: %s", strings.Join(env, " ")))
+	}
+	if len(lines) != 0 {
+		fmt.Printf("\n%s\n", strings.Join(lines, "\n"))
+	}
+}
+
+func parseStringArg(args objx.Map, name string) string {
+	if arg, ok := args[name]; ok {
+		return arg.(string)
+	}
+	return ""
+}
+
 var exclusions []string
-var timeout string
+
+// configs holds the configuration files that apply in and below the current working directory
+var configs *configTree
+
+var matrix []string
+
+// maxJobs limits how many commands run at once, or is zero for no limit
+var maxJobs int
+
+// profile is the name of the selected configuration profile, or empty for none
+var profile string
+
+// packageSets holds the directories found for each target and search, so every command
+// in a run acts on the same packages
+var packageSets = make(map[string][]string)
+
+// commandLine holds the settings given as arguments, which take precedence over every
+// configuration file
+var commandLine = &configuration{}
+
+// noIgnore disables pruning directories ignored by .gitignore and .gorcignore files
+var noIgnore bool
+
+// workspaceModules holds the module directories used by the go.work file, or nil
+// if gorc is not running in a go workspace.
+var workspaceModules []string
+
+// commandEnvironment holds environment variables, in KEY=VALUE form, set for every
+// command gorc runs.
+var commandEnvironment []string
+
+// loadConfig locates and reads the configuration that applies to the current working
+// directory, returning the project configuration file for editing.
+func loadConfig() *configuration {
+	directory, error := getwd()
+	if error != nil {
+		os.Exit(1)
+	}
+	configPath = locateConfig(directory)
+	configs = newConfigTree(directory)
+
+	settings := configs.settingsFor(directory)
+	exclusions = settings.Exclusions
+	matrix = settings.Matrix
+	maxJobs = settings.Jobs
+
+	return readConfig()
+}
+
+// skipBuild skips building the tests before they are run
+var skipBuild bool
+
+// buildDescription describes the nobuild argument in the help of the commands that take it
+const buildDescription = " The tests are built before any are run, and the run is aborted if any fail to build, unless nobuild is true."
+
+// passthroughFlags holds the go test flags given after "--"
+var passthroughFlags []string
+
+// prepareTests applies the arguments that filter and control tests
+func prepareTests(args objx.Map) {
+	if err := parseTestArgs(args, passthroughFlags); err != nil {
+		fmt.Printf("\n%s\n\n", err)
+		os.Exit(1)
+	}
+	batchRun = parseBoolArg(args, "batch")
+	skipBuild = parseBoolArg(args, "nobuild")
+}
 
 func main() {
 
-	var config = readConfig()
-	exclusions = config[configKeyExclusions].([]string)
-	timeout = config[configKeyTimeout].(string)
+	os.Args, passthroughFlags = splitPassthrough(os.Args)
+
+	useWorkspace()
 
 	commander.Go(func() {
 		commander.Map(commander.DefaultCommand, "", "",
 			func(args objx.Map) {
+				prepareWalk(args, "test")
+				prepareTests(args)
 				name := ""
 				if _, ok := args["name"]; ok {
 					name = args["name"].(string)
 				}
 
-				success := false
-				if installTests(name) {
-					success = runTests(name, false)
-				} else {
-					fmt.Printf("Test dependency installation failed. Aborting test run.\n\n")
-				}
+				success := forEachToolchain(func() bool {
+					if !installTests(name) {
+						fmt.Printf("Tests failed to build. Aborting test run.\n\n")
+						return false
+					}
+					return runTests(name, false)
+				})
 				if !success {
 					os.Exit(1)
 				}
 			})
 
-		commander.Map("test [name=(string)] [verbose=(bool)]", "Runs tests, or named test",
-			"If no name argument is specified, runs all tests recursively. If a name argument is specified, runs just that test, unless the argument is \"all\", in which case it runs all tests, including those in the exclusion list.",
+		commander.Map("test [name=(string)] [verbose=(bool)] [run=(string)] [skip=(string)] [short=(bool)] [count=(string)] [shuffle=(string)] [batch=(bool)] [nobuild=(bool)] [noignore=(bool)] [ordered=(bool)] [strict=(bool)] [symlinks=(bool)] [go=(string)] [profile=(string)] [tags=(string)] [env=(string)]", "Runs tests, or named test",
+			"If no name argument is specified, runs all tests recursively. If a name argument is specified, runs just the packages it selects, unless the argument is \"all\", in which case it runs all tests, including those in the exclusion list. The name is a comma separated list of directory names, relative paths, ... patterns (e.g. services/billing/...), globs and import paths."+testArgsDescription+batchDescription+buildDescription+orderedDescription+toolchainDescription,
 			func(args objx.Map) {
+				prepareWalk(args, "test")
+				prepareTests(args)
 				name := ""
 				if _, ok := args["name"]; ok {
 					name = args["name"].(string)
 				}
 				verbose := parseBoolArg(args, "verbose")
 
-				success := false
-				if installTests(name) {
-					success = runTests(name, verbose)
-				} else {
-					fmt.Println("Test dependency installation failed. Aborting test run.")
-				}
+				success := forEachToolchain(func() bool {
+					if !installTests(name) {
+						fmt.Println("Tests failed to build. Aborting test run.")
+						return false
+					}
+					return runTests(name, verbose)
+				})
 				if !success {
 					os.Exit(1)
 				}
 			})
 
-		commander.Map("cover [name=(string)] [out=(string)] [viewer=(string)] [coverArgs=(string)...]", "Runs coverage analysis",
-			"If an out argument is specified, analysis is saved to the file. A viewer may then be specified in order to display the coverage results. If no name argument is specified, runs all tests recursively. If a name argument is specified, runs just that test, unless the argument is \"all\", in which case it runs all tests, including those in the exclusion list.",
+		commander.Map("cover [name=(string)] [out=(string)] [viewer=(string)] [run=(string)] [skip=(string)] [short=(bool)] [count=(string)] [shuffle=(string)] [batch=(bool)] [nobuild=(bool)] [noignore=(bool)] [ordered=(bool)] [strict=(bool)] [symlinks=(bool)] [go=(string)] [profile=(string)] [tags=(string)] [env=(string)] [coverArgs=(string)...]", "Runs coverage analysis",
+			"If an out argument is specified, analysis is saved to the file in each package directory, and packages are not batched. A viewer may then be specified in order to display the coverage results. If no name argument is specified, runs all tests recursively. If a name argument is specified, runs just that test, unless the argument is \"all\", in which case it runs all tests, including those in the exclusion list."+testArgsDescription+batchDescription+buildDescription+orderedDescription+toolchainDescription,
 			func(args objx.Map) {
+				prepareWalk(args, "test")
+				prepareTests(args)
 				out := ""
 				if arg, ok := args["out"]; ok {
 					out = arg.(string)
@@ -340,30 +690,35 @@ func main() {
 					coverArgs = arg.([]string)
 				}
 
-				success := false
-				if installTests(name) {
-					success = runCover(name, out, viewer, coverArgs)
-				} else {
-					fmt.Println("Test dependency installation failed. Aborting test run.")
-				}
+				success := forEachToolchain(func() bool {
+					if !installTests(name) {
+						fmt.Println("Tests failed to build. Aborting test run.")
+						return false
+					}
+					return runCover(name, out, viewer, coverArgs)
+				})
 				if !success {
 					os.Exit(1)
 				}
 			})
 
-		commander.Map("install [name=(string)]", "Installs tests, or named test",
-			"If no name argument is specified, installs all tests recursively. If a name argument is specified, installs just that test, unless the argument is \"all\", in which case it installs all tests, including those in the exclusion list.",
+		commander.Map("install [name=(string)] [noignore=(bool)] [strict=(bool)] [symlinks=(bool)] [go=(string)] [profile=(string)] [tags=(string)] [env=(string)]", "Installs tests, or named test",
+			"If no name argument is specified, installs all tests recursively. If a name argument is specified, installs just that test, unless the argument is \"all\", in which case it installs all tests, including those in the exclusion list."+toolchainDescription,
 			func(args objx.Map) {
+				prepareWalk(args, "install")
 				name := ""
 				if _, ok := args["name"]; ok {
 					name = args["name"].(string)
 				}
-				installTests(name)
+				if !forEachToolchain(func() bool { return installTests(name) }) {
+					os.Exit(1)
+				}
 			})
 
-		commander.Map("lint [name=(string)] [verbose=(bool)]", "Lints packages, or named package",
-			"If no name argument is specified, lints all packages recursively. If a name argument is specified, lints just that package, unless the argument is \"all\", in which case it lints all packages, including those in the exclusion list.",
+		commander.Map("lint [name=(string)] [verbose=(bool)] [noignore=(bool)] [ordered=(bool)] [strict=(bool)] [symlinks=(bool)] [profile=(string)] [tags=(string)] [env=(string)]", "Lints packages, or named package",
+			"If no name argument is specified, lints all packages recursively. If a name argument is specified, lints just that package, unless the argument is \"all\", in which case it lints all packages, including those in the exclusion list."+orderedDescription,
 			func(args objx.Map) {
+				prepareWalk(args, "")
 				name := ""
 				if _, ok := args["name"]; ok {
 					name = args["name"].(string)
@@ -374,57 +729,230 @@ func main() {
 				}
 			})
 
-		commander.Map("vet [name=(string)] [verbose=(bool)]", "Vets packages, or named package",
-			"If no name argument is specified, vets all packages recursively. If a name argument is specified, vets just that package, unless the argument is \"all\", in which case it vets all packages, including those in the exclusion list.",
+		commander.Map("vet [name=(string)] [verbose=(bool)] [matrix=(bool)] [noignore=(bool)] [ordered=(bool)] [strict=(bool)] [symlinks=(bool)] [go=(string)] [profile=(string)] [tags=(string)] [env=(string)]", "Vets packages, or named package",
+			"If matrix is true, vets every package once for each GOOS/GOARCH pair in the configured build matrix, skipping packages whose build constraints exclude a platform. If no name argument is specified, vets all packages recursively. If a name argument is specified, vets just that package, unless the argument is \"all\", in which case it vets all packages, including those in the exclusion list."+orderedDescription+toolchainDescription,
 			func(args objx.Map) {
+				prepareWalk(args, "vet")
 				name := ""
 				if _, ok := args["name"]; ok {
 					name = args["name"].(string)
 				}
 				verbose := parseBoolArg(args, "verbose")
-				if !vetPackages(name, verbose) {
+				if !forEachToolchain(func() bool { return vetPackages(name, verbose, parseBoolArg(args, "matrix")) }) {
 					os.Exit(1)
 				}
 			})
 
-		commander.Map("race [name=(string)]", "Runs race detector on tests, or named test",
-			"If no name argument is specified, race tests all tests recursively. If a name argument is specified, vets just that test, unless the argument is \"all\", in which case it vets all tests, including those in the exclusion list.",
+		commander.Map("race [name=(string)] [run=(string)] [skip=(string)] [short=(bool)] [count=(string)] [shuffle=(string)] [batch=(bool)] [noignore=(bool)] [ordered=(bool)] [strict=(bool)] [symlinks=(bool)] [go=(string)] [profile=(string)] [tags=(string)] [env=(string)]", "Runs race detector on tests, or named test",
+			"If no name argument is specified, race tests all tests recursively. If a name argument is specified, vets just that test, unless the argument is \"all\", in which case it vets all tests, including those in the exclusion list."+testArgsDescription+batchDescription+orderedDescription+toolchainDescription,
 			func(args objx.Map) {
+				prepareWalk(args, "test")
+				prepareTests(args)
 				name := ""
 				if _, ok := args["name"]; ok {
 					name = args["name"].(string)
 				}
-				raceTests(name)
+				if !forEachToolchain(func() bool { return raceTests(name) }) {
+					os.Exit(1)
+				}
+			})
+
+		commander.Map("build [name=(string)] [os=(string)] [arch=(string)] [matrix=(bool)] [verbose=(bool)] [noignore=(bool)] [ordered=(bool)] [strict=(bool)] [symlinks=(bool)] [go=(string)] [profile=(string)] [tags=(string)] [env=(string)]", "Compiles packages, or named package",
+			"Compiles every package, including those without tests. The os and arch arguments accept comma separated lists of GOOS and GOARCH values, and every combination of them is built. If matrix is true, builds for every GOOS/GOARCH pair in the configured build matrix instead and prints a grid of the results. Packages whose build constraints exclude a platform are skipped on it. If no name argument is specified, builds all packages recursively. If a name argument is specified, builds just that package, unless the argument is \"all\", in which case it builds all packages, including those in the exclusion list."+orderedDescription+toolchainDescription,
+			func(args objx.Map) {
+				prepareWalk(args, "build")
+				name := parseStringArg(args, "name")
+				platforms := platformsFor(parseStringArg(args, "os"), parseStringArg(args, "arch"))
+				verbose := parseBoolArg(args, "verbose")
+				success := forEachToolchain(func() bool {
+					if parseBoolArg(args, "matrix") {
+						fmt.Printf("\nBuilding packages. ")
+						return runMatrix(verbose, buildDirectories(name), goCommand, buildArgs...)
+					}
+					return buildPackages(name, platforms, verbose)
+				})
+				if !success {
+					os.Exit(1)
+				}
+			})
+
+		commander.Map("generate [name=(string)] [check=(bool)] [verbose=(bool)] [noignore=(bool)] [strict=(bool)] [symlinks=(bool)] [profile=(string)] [tags=(string)] [env=(string)]", "Runs go generate in packages, or named package",
+			"If check is true, fails if running go generate changed, added or removed any file, and lists those files. If no name argument is specified, generates all packages recursively. If a name argument is specified, generates just that package, unless the argument is \"all\", in which case it generates all packages, including those in the exclusion list.",
+			func(args objx.Map) {
+				prepareWalk(args, "generate")
+				name := parseStringArg(args, "name")
+				check := parseBoolArg(args, "check")
+				verbose := parseBoolArg(args, "verbose")
+				if !generatePackages(name, check, verbose) {
+					os.Exit(1)
+				}
 			})
 
-		commander.Map("exclude name=(string)", "Excludes the named directory from recursion",
-			"An excluded directory will be skipped when walking the directory tree. Any subdirectories of the excluded directory will also be skipped.",
+		commander.Map("mod [action=(string)] [name=(string)] [verbose=(bool)] [noignore=(bool)] [strict=(bool)] [symlinks=(bool)] [profile=(string)] [tags=(string)] [env=(string)]", "Tidies, verifies or checks every module",
+			"Locates every directory containing a go.mod file. The action is one of \"tidy\", which runs go mod tidy in each module, \"verify\", which runs go mod verify in each module, or \"check\" (the default), which fails for any module whose go.mod or go.sum would be changed by go mod tidy, without changing them. If a name argument is specified, acts on just that module, unless the argument is \"all\", in which case it acts on all modules, including those in the exclusion list.",
 			func(args objx.Map) {
-				exclude(args["name"].(string), config)
+				prepareWalk(args, "mod")
+				action := parseStringArg(args, "action")
+				if action == "" {
+					action = modCheck
+				}
+				name := parseStringArg(args, "name")
+				verbose := parseBoolArg(args, "verbose")
+				if !modModules(name, action, verbose) {
+					os.Exit(1)
+				}
+			})
+
+		commander.Map("exclude name=(string)", "Excludes the named directory, or directories matching a pattern, from recursion",
+			"An excluded directory will be skipped when walking the directory tree. Any subdirectories of the excluded directory will also be skipped. A name without a slash excludes every directory with that name. A path containing a slash is matched against the path from the directory of the configuration file holding the pattern, which for the .gorc file at the top of the project is the root of the repository, and where * and ? match within a path element and ** matches any number of elements (e.g. internal/legacy/**). A name beginning with \"re:\" is a regular expression matched against the path, and a name beginning with \"!\" re-includes directories excluded by an earlier pattern.",
+			func(args objx.Map) {
+				if _, err := compileExclusion(args["name"].(string)); err != nil {
+					fmt.Printf("\n%s\n\n", err)
+					os.Exit(1)
+				}
+				loadConfig()
+				reportConfigEdit(exclude(args["name"].(string)))
 				fmt.Printf("\nExcluded \"%s\" from being examined during recursion.\n", args["name"].(string))
-				config = readConfig()
-				exclusions = config[configKeyExclusions].([]string)
+				loadConfig()
 				fmt.Printf("\n%s\n\n", formatExclusionsForPrint(exclusions))
 			})
 
 		commander.Map("include name=(string)", "Removes the named directory from the exclusion list", "",
 			func(args objx.Map) {
-				include(args["name"].(string), config)
+				loadConfig()
+				reportConfigEdit(include(args["name"].(string)))
+				loadConfig()
 				fmt.Printf("\nRemoved \"%s\" from the exclusion list.\n", args["name"].(string))
 				fmt.Printf("\n%s\n\n", formatExclusionsForPrint(exclusions))
 			})
 
-		commander.Map("exclusions", "Prints the exclusion list", "",
+		commander.Map("list [cmd=(string)] [name=(string)] [format=(string)] [noignore=(bool)] [strict=(bool)] [symlinks=(bool)] [profile=(string)]", "Lists the directories a command would act on, and why others are skipped",
+			"Prints every directory visited while walking, along with its status: selected, excluded (naming the pattern and the configuration file it is in), ignored (naming the .gitignore or .gorcignore rule), no matching files, not selected by the name argument, outside workspace or unreadable. Excluded and ignored directories are not walked, so their subdirectories are not listed. The cmd argument is the command to list directories for, and defaults to test. The format argument is text (the default) or json.",
 			func(args objx.Map) {
-				fmt.Printf("\n%s\n\n", formatExclusionsForPrint(exclusions))
+				applyWalkArgs(args)
+				search, ok := searchForCommand(parseStringArg(args, "cmd"))
+				if !ok {
+					fmt.Printf("\nUnknown command \"%s\". Expected test, cover, race, install, build, vet, lint, generate or mod.\n\n", parseStringArg(args, "cmd"))
+					os.Exit(1)
+				}
+				statuses, errs := discoverDirectories(parseStringArg(args, "name"), search)
+				if parseStringArg(args, "cmd") == "build" {
+					for i := range statuses {
+						if statuses[i].Status == statusSelected && !hasPackageFiles(statuses[i].directory) {
+							statuses[i].Status, statuses[i].Reason = statusNoFiles, "only *"+searchTest+" files"
+						}
+					}
+				}
+				if strictWalk && len(errs) != 0 {
+					recordWalkErrors(errs)
+				}
+				if !printDirectoryStatuses(statuses, parseStringArg(args, "format")) {
+					os.Exit(1)
+				}
+			})
+
+		commander.Map("exclusions", "Prints the exclusion list and the directories each entry matches", "",
+			func(args objx.Map) {
+				directory, err := getwd()
+				if err != nil {
+					os.Exit(1)
+				}
+				loadConfig()
+				matches := make(map[string][]string)
+				for _, layer := range configs.layersFor(directory) {
+					for source, paths := range exclusionMatches(layer.directory, layer.patterns) {
+						matches[source] = append(matches[source], paths...)
+					}
+				}
+				fmt.Printf("\n%s\n\n", formatExclusionMatchesForPrint(exclusions, matches))
 			})
 
 		commander.Map("timeout value=(string)", "Sets the test timeout", "",
 			func(args objx.Map) {
-				timeoutAfter(args["value"].(string), config)
+				if _, err := time.ParseDuration(args["value"].(string)); err != nil {
+					fmt.Printf("\n\"%s\" is not a valid timeout. Expected a duration such as \"30s\" or \"10m\".\n\n", args["value"])
+					os.Exit(1)
+				}
+				loadConfig()
+				reportConfigEdit(timeoutAfter(args["value"].(string)))
 				fmt.Printf("\nSet test timeout to \"%s\".\n", args["value"])
 			})
 
+		commander.Map("config action=(string) [key=(string)] [value=(string)] [format=(string)] [force=(bool)]", "Manages the configuration files",
+			"The action \"list\" prints every key set in the nearest .gorc file, \"get\" prints the value of a key, \"set\" sets a key to a value and \"unset\" removes a key. List values are given as comma separated values. Edits are checked before they are saved, and keep the rest of the file, including comments and keys gorc does not recognize, as it was. The action \"validate\" checks the user-global configuration file and every .gorc file that applies in or below the current directory, reporting each problem along with the key it was found at. Files written by an older version of gorc are read as if they had been migrated, and are saved in the current format when they are next edited or converted; the action \"migrate\" saves them all in the current format now. The action \"convert\" rewrites the nearest .gorc file in the given format, which is one of json (.gorc), yaml (.gorc.yaml) or toml (.gorc.toml). A file already in that format is not replaced unless force is true. When a directory holds files in more than one format, .gorc takes precedence over .gorc.yaml, which takes precedence over .gorc.toml.",
+			func(args objx.Map) {
+				directory, err := getwd()
+				if err != nil {
+					os.Exit(1)
+				}
+				switch action := args["action"].(string); action {
+				case "validate":
+					if !validateConfigFiles(configFilePaths(directory)) {
+						os.Exit(1)
+					}
+				case "migrate":
+					if !migrateConfigFiles(configFilePaths(directory)) {
+						os.Exit(1)
+					}
+				case "list", "get":
+					loadConfig()
+					_, values, err := readConfigDocument(configPath)
+					if err != nil {
+						fmt.Printf("\nCould not read %s: %s\n\n", configPath, err)
+						os.Exit(1)
+					}
+					if action == "get" {
+						key := parseStringArg(args, "key")
+						value, ok := values[key]
+						if !ok {
+							fmt.Printf("Key \"%s\" is not set in %s\n", key, configPath)
+							os.Exit(1)
+						}
+						fmt.Println(formatConfigValue(value))
+						return
+					}
+					keys := make([]string, 0, len(values))
+					for key := range values {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						var value bytes.Buffer
+						json.Compact(&value, values[key])
+						fmt.Printf("%s=%s\n", key, value.String())
+					}
+				case "set", "unset":
+					loadConfig()
+					key := parseStringArg(args, "key")
+					var value json.RawMessage
+					if action == "set" {
+						if value, err = configValueFromString(key, parseStringArg(args, "value")); err != nil {
+							fmt.Printf("\n%s\n\n", err)
+							os.Exit(1)
+						}
+					}
+					removed, err := editConfigKey(configPath, key, value)
+					if err != nil {
+						fmt.Printf("\nCould not %s %s in %s: %s\n\n", action, key, configPath, err)
+						os.Exit(1)
+					}
+					if removed {
+						fmt.Printf("\nRemoved %s as it no longer holds any settings.\n\n", configPath)
+					}
+				case "convert":
+					loadConfig()
+					path, err := convertConfig(configPath, parseStringArg(args, "format"), parseBoolArg(args, "force"))
+					if err != nil {
+						fmt.Printf("\nCould not convert %s: %s\n\n", configPath, err)
+						os.Exit(1)
+					}
+					fmt.Printf("\nConverted configuration to %s.\n\n", path)
+				default:
+					fmt.Printf("\nUnknown config action \"%s\". Expected list, get, set, unset, validate, migrate or convert.\n\n", action)
+					os.Exit(1)
+				}
+			})
+
 	})
 
 }
@@ -1 +1,130 @@
 package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// benchmarkTree creates a directory tree with breadth subdirectories at each of depth
+// levels, each holding a go file and a test file, and returns its root
+func benchmarkTree(b *testing.B, breadth, depth int) string {
+	root := b.TempDir()
+	var create func(directory string, level int)
+	create = func(directory string, level int) {
+		for _, name := range []string{"package.go", "package_test.go"} {
+			if err := ioutil.WriteFile(filepath.Join(directory, name), []byte("package p\n"), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if level == depth {
+			return
+		}
+		for i := 0; i < breadth; i++ {
+			subdirectory := filepath.Join(directory, fmt.Sprintf("d%d", i))
+			if err := os.Mkdir(subdirectory, 0755); err != nil {
+				b.Fatal(err)
+			}
+			create(subdirectory, level+1)
+		}
+	}
+	create(root, 0)
+	return root
+}
+
+// BenchmarkRecurseDirectories compares walking a large tree one directory at a time
+// with walking it concurrently, both on local disk and on a simulated network mount
+// where every directory read takes a while to answer
+func BenchmarkRecurseDirectories(b *testing.B) {
+	root := benchmarkTree(b, 6, 4)
+	workers, read := walkWorkers, readDirectory
+	defer func() { walkWorkers, readDirectory = workers, read }()
+
+	for _, latency := range []time.Duration{0, 200 * time.Microsecond} {
+		for _, count := range []int{0, workers} {
+			b.Run(fmt.Sprintf("latency=%s/workers=%d", latency, count), func(b *testing.B) {
+				walkWorkers = count
+				readDirectory = func(directory string) ([]os.DirEntry, error) {
+					time.Sleep(latency)
+					return read(directory)
+				}
+				for i := 0; i < b.N; i++ {
+					found := 0
+					errs := recurseDirectories(root, searchTest,
+						func(string) bool { return false },
+						func(_ string, matched bool) {
+							if matched {
+								found++
+							}
+						})
+					if len(errs) != 0 || found != 1555 {
+						b.Fatalf("found %d directories with %d errors", found, len(errs))
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestBuildTestsOrdered checks that building tests in dependency order skips the
+// tests of a package importing one that does not compile, rather than failing them
+// with the same error
+func TestBuildTestsOrdered(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":      "module example.com/dep\n\ngo 1.16\n",
+		"a/a.go":      "package a\n\nfunc A() { undefined() }\n",
+		"a/a_test.go": "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n",
+		"b/b.go":      "package b\n\nimport \"example.com/dep/a\"\n\nfunc B() { a.A() }\n",
+		"b/b_test.go": "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	working, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	ordered := orderedRun
+	defer func() {
+		os.Chdir(working)
+		orderedRun = ordered
+		packageSets = make(map[string][]string)
+	}()
+	orderedRun = true
+	loadConfig()
+
+	outputs := buildTests("", activeRelease())
+	if len(outputs) != 2 {
+		t.Fatalf("got %d outputs, want 2", len(outputs))
+	}
+	for _, output := range outputs {
+		switch filepath.Base(output.directory) {
+		case "a":
+			if output.err == nil || jobSkipped(output) {
+				t.Errorf("a: got error %v, want a build failure", output.err)
+			}
+		case "b":
+			if !jobSkipped(output) {
+				t.Errorf("b: got error %v and output %q, want it skipped", output.err, output.output)
+			}
+		}
+	}
+}
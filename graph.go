@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// errDependencyFailed is the error of a job skipped because a package it imports failed
+var errDependencyFailed = errors.New("dependency failed")
+
+// orderedDescription describes the ordered argument in the help of the commands that take it
+const orderedDescription = " If ordered is true, packages are run after the packages they import, and packages importing one that failed are skipped rather than run. Packages in an import cycle are not ordered among themselves."
+
+// orderedRun makes commands run in dependency order, skipping the dependents of any
+// package that fails
+var orderedRun bool
+
+// packageImports returns the import paths imported by the go files of the package in
+// directory that are built in context, leaving out its tests
+func packageImports(directory string, context *build.Context) []string {
+	files, _ := filepath.Glob(filepath.Join(directory, "*"+searchGo))
+	var imports []string
+	for _, file := range files {
+		if strings.HasSuffix(file, searchTest) {
+			continue
+		}
+		if match, err := context.MatchFile(directory, filepath.Base(file)); err != nil || !match {
+			continue
+		}
+		parsed, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, spec := range parsed.Imports {
+			if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+				imports = append(imports, path)
+			}
+		}
+	}
+	return imports
+}
+
+// importPathFor returns the import path of the package in directory, worked out from
+// the go.mod file of the module containing it, or an empty string if it is not in a
+// module
+func importPathFor(directory string, modulePaths map[string]string) string {
+	root := moduleRootFor(directory, modulePaths)
+	if root == "" {
+		return ""
+	}
+	relative := slashRelativePath(root, directory)
+	if relative == "." {
+		return modulePaths[root]
+	}
+	return modulePaths[root] + "/" + relative
+}
+
+// moduleRootFor returns the directory holding the go.mod file of the module containing
+// directory, or an empty string if it is not in a module. The module paths read are
+// kept in modulePaths, keyed by directory.
+func moduleRootFor(directory string, modulePaths map[string]string) string {
+	for current := directory; ; current = filepath.Dir(current) {
+		modulePath, ok := modulePaths[current]
+		if !ok {
+			modulePath = readModulePath(current)
+			modulePaths[current] = modulePath
+		}
+		if modulePath != "" {
+			return current
+		}
+		if filepath.Dir(current) == current {
+			return ""
+		}
+	}
+}
+
+// buildContextFor returns the build context the go command of the job selects files
+// with, taking GOOS, GOARCH and CGO_ENABLED from its environment and the build tags
+// from its arguments
+func buildContextFor(j job) build.Context {
+	context := build.Default
+	cgo := ""
+	for _, variable := range append(append(os.Environ(), commandEnvironment...), j.env...) {
+		equals := strings.Index(variable, "=")
+		if equals == -1 || equals == len(variable)-1 {
+			continue
+		}
+		switch name, value := variable[:equals], variable[equals+1:]; name {
+		case "GOOS":
+			context.GOOS = value
+		case "GOARCH":
+			context.GOARCH = value
+		case "CGO_ENABLED":
+			cgo = value
+		}
+	}
+	// Like the go command, cgo is off when cross compiling unless it is enabled
+	switch {
+	case cgo != "":
+		context.CgoEnabled = cgo == "1"
+	case context.GOOS != runtime.GOOS || context.GOARCH != runtime.GOARCH:
+		context.CgoEnabled = false
+	}
+	context.BuildTags = buildTagsArg(j.args)
+	return context
+}
+
+// buildTagsArg returns the build tags given by the -tags flag in the go command
+// arguments, if any
+func buildTagsArg(args []string) []string {
+	var tags []string
+	for i, arg := range args {
+		if arg == "-args" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		// Flags may be given with one dash or two
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		switch {
+		case strings.HasPrefix(arg, "tags="):
+			tags = splitTags(arg[len("tags="):])
+		case arg == "tags" && i+1 < len(args):
+			tags = splitTags(args[i+1])
+		}
+	}
+	return tags
+}
+
+// splitTags splits a list of build tags, which are separated by commas or, in older
+// releases of go, by spaces
+func splitTags(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// contextKey returns a key identifying the files a build context selects
+func contextKey(context *build.Context) string {
+	return fmt.Sprintf("%s/%s cgo=%t tags=%s", context.GOOS, context.GOARCH, context.CgoEnabled, strings.Join(context.BuildTags, ","))
+}
+
+// jobDependencies returns, for each job, the indexes of the jobs in other directories
+// whose packages it imports, directly or through packages that are not being run.
+// Imports are read from the files each job builds, and a job only depends on jobs
+// building for the same platform and tags, as a build matrix runs every package once
+// for each platform. Packages in an import cycle do not depend on each other, so
+// that they do not wait for each other forever.
+func jobDependencies(jobs []job) [][]int {
+	// Every package is part of the graph, so imports through packages that are not
+	// being run are still followed
+	modulePaths := make(map[string]string)
+	directories := make(map[string]string)
+	for _, directory := range findDirectories(targetAll, searchGo) {
+		if importPath := importPathFor(directory, modulePaths); importPath != "" {
+			directories[importPath] = directory
+		}
+	}
+
+	contexts := make(map[string]*build.Context)
+	variants := make([]string, len(jobs))
+	jobIndexes := make(map[string]int)
+	for i, j := range jobs {
+		context := buildContextFor(j)
+		variants[i] = contextKey(&context)
+		if _, ok := contexts[variants[i]]; !ok {
+			contexts[variants[i]] = &context
+		}
+		jobIndexes[variants[i]+"\x00"+j.directory] = i
+	}
+
+	// imported holds the directories of the packages each package imports, keyed by
+	// the variant and the directory of the package
+	imported := make(map[string][]string)
+	importsOf := func(variant, directory string) []string {
+		key := variant + "\x00" + directory
+		if result, ok := imported[key]; ok {
+			return result
+		}
+		var result []string
+		for _, importPath := range packageImports(directory, contexts[variant]) {
+			if dependency, ok := directories[importPath]; ok && dependency != directory {
+				result = append(result, dependency)
+			}
+		}
+		imported[key] = result
+		return result
+	}
+
+	// reached holds, for each job, the directories its package imports directly or
+	// indirectly
+	reached := make([]map[string]bool, len(jobs))
+	for i, j := range jobs {
+		reached[i] = make(map[string]bool)
+		pending := []string{j.directory}
+		for len(pending) != 0 {
+			current := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			for _, dependency := range importsOf(variants[i], current) {
+				if !reached[i][dependency] {
+					reached[i][dependency] = true
+					pending = append(pending, dependency)
+				}
+			}
+		}
+	}
+
+	dependencies := make([][]int, len(jobs))
+	for i, j := range jobs {
+		for directory := range reached[i] {
+			dependency, ok := jobIndexes[variants[i]+"\x00"+directory]
+			// A package that reaches a package importing it is in an import cycle
+			// with it, which go reports when either is built
+			if !ok || dependency == i || reached[dependency][j.directory] {
+				continue
+			}
+			dependencies[i] = append(dependencies[i], dependency)
+		}
+	}
+	return dependencies
+}
+
+// runJobsOrdered runs the jobs concurrently, each starting once the jobs of the
+// packages it imports have finished. A job whose dependency failed or was skipped is
+// skipped too, rather than failing with errors caused by its dependency. The outputs
+// are returned in the same order as the jobs.
+func runJobsOrdered(jobs []job) []cmdOutput {
+	dependencies := jobDependencies(jobs)
+	done := make([]chan struct{}, len(jobs))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	// failed holds, for each job that failed or was skipped, the directory whose job failed
+	failed := make([]string, len(jobs))
+
+	waitFor := func(index int) {
+		for _, dependency := range dependencies[index] {
+			<-done[dependency]
+			if failed[dependency] != "" && failed[index] == "" {
+				failed[index] = failed[dependency]
+			}
+		}
+	}
+
+	return runParallelAfter(len(jobs), waitFor, func(index int) cmdOutput {
+		j := jobs[index]
+		defer close(done[index])
+		if failed[index] != "" {
+			output := fmt.Sprintf("%s: skipped: dependency failed (%s)", relativePath(j.directory), relativePath(failed[index]))
+			return cmdOutput{j.directory, output, errDependencyFailed}
+		}
+		out, err := runShellCommandEnv(j.directory, j.env, j.command, j.args...)
+		if err != nil {
+			failed[index] = j.directory
+		}
+		return cmdOutput{j.directory, out, err}
+	})
+}
+
+// runJobsInOrder runs the jobs in dependency order if ordered runs are enabled, or
+// else all at once
+func runJobsInOrder(jobs []job) []cmdOutput {
+	if orderedRun {
+		return runJobsOrdered(jobs)
+	}
+	return runJobsParallel(jobs)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildTagsArg(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"no tags", []string{"test", "-v"}, nil},
+		{"one dash", []string{"test", "-tags=integration"}, []string{"integration"}},
+		{"two dashes", []string{"test", "--tags=integration"}, []string{"integration"}},
+		{"separate value", []string{"vet", "-tags", "integration,linux"}, []string{"integration", "linux"}},
+		{"spaces", []string{"build", "-tags=a b"}, []string{"a", "b"}},
+		{"last wins", []string{"test", "-tags=a", "-tags=b"}, []string{"b"}},
+		{"value named tags", []string{"test", "-run", "tags"}, nil},
+		{"after -args", []string{"test", "-args", "-tags=a"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := buildTagsArg(test.args); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("buildTagsArg(%q) = %q, want %q", test.args, got, test.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -16,15 +19,6 @@ func sliceContainsString(target string, slice []string) (bool, int) {
 	return false, -1
 }
 
-// stringSliceFromInterfaceSlice creates a []string from a []interface{}
-func stringSliceFromInterfaceSlice(interfaceSlice []interface{}) []string {
-	retval := make([]string, len(interfaceSlice))
-	for i, str := range interfaceSlice {
-		retval[i] = str.(string)
-	}
-	return retval
-}
-
 // formatExclusionsForPrint returns a string detailing all excluded directories.
 func formatExclusionsForPrint(exclusions []string) string {
 
@@ -33,12 +27,90 @@ func formatExclusionsForPrint(exclusions []string) string {
 
 }
 
+// relativePath returns the directory relative to the current working directory,
+// or the directory unchanged if it is not below it.
+func relativePath(directory string) string {
+	if workingDirectory, err := os.Getwd(); err == nil {
+		if relative, err := filepath.Rel(workingDirectory, directory); err == nil && !strings.HasPrefix(relative, "..") {
+			return relative
+		}
+	}
+	return directory
+}
+
+// formatExclusionMatchesForPrint returns a string detailing all excluded directories,
+// along with the directories each of them matches.
+func formatExclusionMatchesForPrint(exclusions []string, matches map[string][]string) string {
+
+	lines := []string{"Excluded Directories:"}
+	for _, exclusion := range exclusions {
+		lines = append(lines, "\t"+exclusion)
+		if len(matches[exclusion]) == 0 {
+			lines = append(lines, "\t\t(no matching directories)")
+		}
+		for _, match := range matches[exclusion] {
+			lines = append(lines, "\t\t"+match)
+		}
+	}
+	return strings.Join(lines, "\n")
+
+}
+
 // runShellCommand runs a shell command in a specified directory and returns
 // a string containing all output.
 func runShellCommand(directory, command string, arguments ...string) (string, error) {
+	return runShellCommandEnv(directory, nil, command, arguments...)
+}
+
+// runShellCommandEnv runs a shell command in a specified directory with additional
+// environment variables (in KEY=VALUE form) and returns a string containing all output.
+func runShellCommandEnv(directory string, env []string, command string, arguments ...string) (string, error) {
 	shellCommand := exec.Command(command, arguments...)
 	shellCommand.Dir = directory
+	if len(commandEnvironment) != 0 || len(env) != 0 {
+		shellCommand.Env = append(append(os.Environ(), commandEnvironment...), env...)
+	}
 
 	output, err := shellCommand.CombinedOutput()
 	return string(output), err
 }
+
+// splitList splits a comma separated list, discarding empty entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// envVariableName matches the start of a KEY=VALUE environment variable
+var envVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// parseEnvList parses comma separated environment variables in KEY=VALUE form. A
+// comma is only taken to separate variables if it is followed by another KEY=, so
+// values may contain commas.
+func parseEnvList(list string) (map[string]string, error) {
+	env := make(map[string]string)
+	var variables []string
+	for _, segment := range strings.Split(list, ",") {
+		if envVariableName.MatchString(strings.TrimSpace(segment)) || len(variables) == 0 {
+			variables = append(variables, strings.TrimSpace(segment))
+		} else {
+			variables[len(variables)-1] += "," + segment
+		}
+	}
+	for _, variable := range variables {
+		if variable == "" {
+			continue
+		}
+		if !envVariableName.MatchString(variable) {
+			return nil, fmt.Errorf(errorInvalidEnv, variable)
+		}
+		parts := strings.SplitN(variable, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	return env, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// globalConfigDirectory is the name of gorc's directory within the user's configuration directory
+	globalConfigDirectory = "gorc"
+
+	// globalConfigFilename is the name of the user-global configuration file
+	globalConfigFilename = "config"
+)
+
+// fileExists determines if anything exists at path
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// globalConfigPath returns the path of the user-global configuration file, which
+// lives in $XDG_CONFIG_HOME, or ~/.config if that is not set. The file may be in any
+// of the configuration formats.
+func globalConfigPath() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	directory := filepath.Join(configHome, globalConfigDirectory)
+	if path := configFileIn(directory, globalConfigFilename); path != "" {
+		return path
+	}
+	return filepath.Join(directory, globalConfigFilename)
+}
+
+// projectRoot returns the directory at which the upward search for configuration
+// files stops: the root of the enclosing git repository, or failing that the root
+// of the enclosing module, or failing that start itself.
+func projectRoot(start string) string {
+	for _, marker := range []string{gitDirectory, searchModule} {
+		for directory := start; ; {
+			if fileExists(filepath.Join(directory, marker)) {
+				return directory
+			}
+			parent := filepath.Dir(directory)
+			if parent == directory {
+				break
+			}
+			directory = parent
+		}
+	}
+	return start
+}
+
+// locateConfig returns the path of the nearest configuration file in or above start,
+// without going above the project root. If there is none, the path in start is
+// returned, so that is where a new configuration file will be written.
+func locateConfig(start string) string {
+	root := projectRoot(start)
+	for directory := start; ; directory = filepath.Dir(directory) {
+		if path := configFileIn(directory, configFilename); path != "" {
+			return path
+		}
+		if directory == root || filepath.Dir(directory) == directory {
+			break
+		}
+	}
+	return filepath.Join(start, configFilename)
+}
+
+// configLayer is a configuration file, along with the directory its exclusion
+// patterns are relative to.
+type configLayer struct {
+	path      string
+	directory string
+	config    *configuration
+	patterns  []exclusionPattern
+}
+
+// newConfigLayer compiles the exclusion patterns of a configuration, including those
+// of the selected profile. The patterns have already been validated when the
+// configuration was read.
+func newConfigLayer(path, directory string, config *configuration) *configLayer {
+	patterns, _ := compileExclusions(config.withProfile(profile).Exclusions)
+	return &configLayer{path, directory, config, patterns}
+}
+
+// configTree holds the user-global configuration and every configuration file from
+// the project root down, reading each file once. Files deeper in the tree override
+// the settings of those above them for their subtree. It is safe for concurrent use.
+type configTree struct {
+	root   string
+	global *configLayer
+	lock   sync.Mutex
+	layers map[string]*configLayer
+}
+
+// newConfigTree creates a configTree for the project containing start
+func newConfigTree(start string) *configTree {
+	tree := &configTree{root: projectRoot(start), layers: make(map[string]*configLayer)}
+	if path := globalConfigPath(); path != "" {
+		tree.global = newConfigLayer(path, tree.root, readConfigFile(path))
+	}
+	return tree
+}
+
+// layer returns the configuration file in directory, or nil if there is none
+func (t *configTree) layer(directory string) *configLayer {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	layer, ok := t.layers[directory]
+	if !ok {
+		if path := configFileIn(directory, configFilename); path != "" {
+			layer = newConfigLayer(path, directory, readConfigFile(path))
+		}
+		t.layers[directory] = layer
+	}
+	return layer
+}
+
+// layersFor returns the configuration that applies to directory, starting with the
+// user-global configuration followed by each file from the project root down.
+func (t *configTree) layersFor(directory string) []*configLayer {
+	var layers []*configLayer
+	if t.global != nil {
+		layers = append(layers, t.global)
+	}
+
+	directories := []string{t.root}
+	if relative, err := filepath.Rel(t.root, directory); err == nil && relative != "." && !strings.HasPrefix(relative, "..") {
+		for _, element := range strings.Split(relative, string(os.PathSeparator)) {
+			directories = append(directories, filepath.Join(directories[len(directories)-1], element))
+		}
+	}
+
+	for _, current := range directories {
+		if layer := t.layer(current); layer != nil {
+			layers = append(layers, layer)
+		}
+	}
+	return layers
+}
+
+// settingsFor returns the configuration in effect for directory. Exclusions accumulate
+// down the tree, while other settings are replaced by deeper files that set them. The
+// selected profile of each file is applied over that file's own settings, followed by
+// the file's overrides that match directory. Settings given on the command line are
+// applied last.
+func (t *configTree) settingsFor(directory string) *configuration {
+	settings := newConfiguration()
+	for _, layer := range t.layersFor(directory) {
+		config := layer.config.withProfile(profile)
+		settings.merge(config)
+		relative := slashRelativePath(layer.directory, directory)
+		for _, override := range config.Overrides {
+			if override.appliesTo(relative) {
+				settings.merge(override.settings())
+			}
+		}
+	}
+	settings.merge(commandLine)
+	// The overrides have been applied, and their paths are relative to other directories
+	settings.Overrides = nil
+	return settings
+}
+
+// definesProfile determines if any configuration file that applies to directory
+// defines the named profile
+func (t *configTree) definesProfile(directory, name string) bool {
+	for _, layer := range t.layersFor(directory) {
+		if _, ok := layer.config.Profiles[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded determines if directory is excluded by the patterns of the configuration
+// files above it
+func (t *configTree) excluded(directory string) bool {
+	_, excluded := t.excludedBy(directory)
+	return excluded
+}
+
+// excludedBy determines if directory is excluded by the patterns of the configuration
+// files above it, each matched against the path relative to its own file, and if so
+// describes the pattern that excludes it. When several patterns match, those in
+// deeper files take precedence.
+func (t *configTree) excludedBy(directory string) (string, bool) {
+	excluded, reason := false, ""
+	for _, layer := range t.layersFor(filepath.Dir(directory)) {
+		relative := slashRelativePath(layer.directory, directory)
+		for _, pattern := range layer.patterns {
+			if pattern.matches(relative) {
+				excluded = !pattern.negate
+				reason = fmt.Sprintf("excluded by \"%s\" in %s", pattern.source, relativePath(layer.path))
+			}
+		}
+	}
+	return reason, excluded
+}
+
+// configFilePaths returns the path of every configuration file that applies in or
+// below directory: the user-global file, those from the project root down to
+// directory, and those in its subdirectories. Files that are ignored because another
+// format takes precedence in the same directory are included too.
+func configFilePaths(directory string) []string {
+	var paths []string
+	if path := globalConfigPath(); path != "" {
+		paths = append(paths, configFilesIn(filepath.Dir(path), globalConfigFilename)...)
+	}
+
+	var above []string
+	root := projectRoot(directory)
+	for current := directory; current != root && filepath.Dir(current) != current; {
+		current = filepath.Dir(current)
+		above = append(configFilesIn(current, configFilename), above...)
+	}
+	paths = append(paths, above...)
+
+	names := configFileNames(configFilename)
+
+	filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && info.Name() == gitDirectory {
+			return filepath.SkipDir
+		}
+		if contains, _ := sliceContainsString(info.Name(), names); contains && !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths
+}
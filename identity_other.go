@@ -0,0 +1,18 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// directoryIdentity returns a key identifying the directory at path, however it is
+// reached. Without device and inode numbers, the path with every link resolved is used.
+func directoryIdentity(path string, info os.FileInfo) (string, bool) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", false
+	}
+	return resolved, true
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// directoryIdentity returns a key identifying the directory at path, however it is
+// reached. Windows does not expose file IDs through os.FileInfo, so the path with
+// every link resolved is used instead.
+func directoryIdentity(path string, info os.FileInfo) (string, bool) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.ToLower(resolved), true
+}
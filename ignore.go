@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// gitIgnoreFilename is the name of git's ignore file
+	gitIgnoreFilename = ".gitignore"
+
+	// gorcIgnoreFilename is the name of gorc's own ignore file, which uses the same syntax
+	gorcIgnoreFilename = ".gorcignore"
+
+	// gitDirectory is the name of git's metadata directory, which is never walked
+	gitDirectory = ".git"
+)
+
+// ignoreFilenames are the ignore files read from each directory, in order of precedence
+var ignoreFilenames = []string{gitIgnoreFilename, gorcIgnoreFilename}
+
+// ignoreRule is a single line of an ignore file
+type ignoreRule struct {
+	base     string
+	elements []string
+	negate   bool
+	anchored bool
+
+	// file and line are where the rule was read from, for explaining why a directory is ignored
+	file string
+	line string
+}
+
+// parseIgnoreRule parses a line of an ignore file found in the directory base,
+// returning false if the line holds no rule.
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	rule := ignoreRule{base: base, line: line}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	// Only directories are checked, so a trailing slash makes no difference
+	line = strings.TrimRight(line, "/")
+	if line == "" {
+		return rule, false
+	}
+
+	// A slash anywhere but the end anchors the pattern to the directory of the ignore file
+	rule.anchored = strings.Contains(line, "/")
+	rule.elements = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	return rule, true
+}
+
+// matches determines if the rule matches the directory, given as a slash separated
+// path relative to the directory of its ignore file.
+func (r ignoreRule) matches(relativePath string) bool {
+	if !r.anchored {
+		matched, _ := path.Match(r.elements[0], path.Base(relativePath))
+		return matched
+	}
+	return matchGlob(r.elements, strings.Split(relativePath, "/"))
+}
+
+// readIgnoreRules reads the rules of every ignore file in directory
+func readIgnoreRules(directory string) []ignoreRule {
+	var rules []ignoreRule
+	for _, name := range ignoreFilenames {
+		file, err := os.Open(filepath.Join(directory, name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreRule(directory, scanner.Text()); ok {
+				rule.file = filepath.Join(directory, name)
+				rules = append(rules, rule)
+			}
+		}
+		file.Close()
+	}
+	return rules
+}
+
+// ignoreMatcher determines which directories are ignored by the .gitignore and
+// .gorcignore files in and above them, reading each ignore file once. It is safe for
+// concurrent use.
+type ignoreMatcher struct {
+	top   string
+	lock  sync.Mutex
+	rules map[string][]ignoreRule
+}
+
+// newIgnoreMatcher creates an ignoreMatcher for walking root. Ignore files are read
+// from the top of the enclosing git repository, if there is one, so rules in parent
+// directories apply as they do for git.
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	top := root
+	for current := root; ; {
+		if info, err := os.Stat(filepath.Join(current, gitDirectory)); err == nil && info.IsDir() {
+			top = current
+			break
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			break
+		}
+		current = parent
+	}
+	return &ignoreMatcher{top: top, rules: make(map[string][]ignoreRule)}
+}
+
+// rulesFor returns the rules of the ignore files in directory
+func (m *ignoreMatcher) rulesFor(directory string) []ignoreRule {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rules, ok := m.rules[directory]
+	if !ok {
+		rules = readIgnoreRules(directory)
+		m.rules[directory] = rules
+	}
+	return rules
+}
+
+// ignored determines if the directory is ignored
+func (m *ignoreMatcher) ignored(directory string) bool {
+	_, ignored := m.ignoredBy(directory)
+	return ignored
+}
+
+// ignoredBy determines if the directory is ignored, and if so describes the rule that
+// ignores it. Rules in deeper ignore files, and later lines of the same file, take
+// precedence.
+func (m *ignoreMatcher) ignoredBy(directory string) (string, bool) {
+	if filepath.Base(directory) == gitDirectory {
+		return "git metadata is never walked", true
+	}
+
+	relative, err := filepath.Rel(m.top, directory)
+	if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+		return "", false
+	}
+
+	// Collect the directories from the top down to the parent of the directory
+	parents := []string{m.top}
+	elements := strings.Split(filepath.ToSlash(relative), "/")
+	for _, element := range elements[:len(elements)-1] {
+		parents = append(parents, filepath.Join(parents[len(parents)-1], element))
+	}
+
+	ignored, reason := false, ""
+	for _, parent := range parents {
+		for _, rule := range m.rulesFor(parent) {
+			if rule.matches(slashRelativePath(rule.base, directory)) {
+				ignored = !rule.negate
+				reason = fmt.Sprintf("ignored by \"%s\" in %s", rule.line, relativePath(rule.file))
+			}
+		}
+	}
+	return reason, ignored
+}
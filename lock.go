@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// configLockTimeout is how long gorc waits for another gorc to finish editing a configuration file
+	configLockTimeout = 30 * time.Second
+
+	// lockFilename is the name of the file created to lock a directory on platforms without flock
+	lockFilename = ".gorc.lock"
+
+	// configLockRetryInterval is how often gorc retries taking a lock held by another gorc
+	configLockRetryInterval = 50 * time.Millisecond
+)
+
+// lockConfigFile takes an advisory lock on the directory holding the configuration
+// file at path, waiting for any other gorc editing a configuration file there to
+// finish. Every read-modify-write of a configuration file happens under this lock, so
+// concurrent edits are applied one after another rather than overwriting each other.
+func lockConfigFile(path string) (unlock func(), err error) {
+	directory := filepath.Dir(path)
+	deadline := time.Now().Add(configLockTimeout)
+	for {
+		unlock, locked, err := tryLockDirectory(directory)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return unlock, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf(errorConfigLocked, path, configLockTimeout)
+		}
+		time.Sleep(configLockRetryInterval)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !(darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || windows)
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tryLockDirectory attempts to take an exclusive lock on directory without waiting, by
+// creating a lock file within it that must not already exist. The lock is released by
+// the returned function. A lock file left behind by a gorc that exited abruptly is
+// taken over once it is older than configLockTimeout, as no edit takes that long.
+func tryLockDirectory(directory string) (unlock func(), locked bool, err error) {
+	path := filepath.Join(directory, lockFilename)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > configLockTimeout {
+			os.Remove(path)
+		}
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	file.Close()
+	return func() {
+		os.Remove(path)
+	}, true, nil
+}
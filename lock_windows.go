@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// fileFlagDeleteOnClose removes the lock file once its handle is closed, even if gorc exits abruptly
+	fileFlagDeleteOnClose = 0x04000000
+
+	// errorSharingViolation is returned when another process holds the lock file open
+	errorSharingViolation syscall.Errno = 32
+)
+
+// tryLockDirectory attempts to take an exclusive lock on directory without waiting, by
+// opening a lock file within it that no other process may share. The lock is released
+// by the returned function, or when gorc exits.
+func tryLockDirectory(directory string) (unlock func(), locked bool, err error) {
+	name, err := syscall.UTF16PtrFromString(filepath.Join(directory, lockFilename))
+	if err != nil {
+		return nil, false, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_HIDDEN|fileFlagDeleteOnClose, 0)
+	if err == errorSharingViolation || err == syscall.ERROR_ACCESS_DENIED {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return func() {
+		syscall.CloseHandle(handle)
+	}, true, nil
+}
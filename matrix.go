@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// parsePlatform parses a platform in GOOS/GOARCH form
+func parsePlatform(value string) (platform, error) {
+	parts := strings.Split(strings.TrimSpace(value), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return platform{}, fmt.Errorf(errorInvalidPlatform, value)
+	}
+	return platform{parts[0], parts[1]}, nil
+}
+
+// matrixPlatforms returns the platforms declared in the configured build matrix
+func matrixPlatforms() ([]platform, error) {
+	platforms := make([]platform, 0, len(matrix))
+	for _, value := range matrix {
+		p, err := parsePlatform(value)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// runMatrix runs the command in each of the directories once per platform, cross
+// compiling via GOOS/GOARCH, and prints a grid of package against platform results.
+// Ordered runs order the packages of each platform separately, and packages that
+// build constraints exclude from a platform are shown as "-" rather than run.
+func runMatrix(verbose bool, directories []string, command string, args ...string) bool {
+	platforms, err := matrixPlatforms()
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		return false
+	}
+	if len(platforms) == 0 {
+		fmt.Printf("No build matrix is configured. Add GOOS/GOARCH pairs to the \"%s\" list in %s.\n\n", configKeyMatrix, configFilename)
+		return false
+	}
+
+	if len(directories) == 0 {
+		printSummary("packages", "run", 0, 0)
+		return true
+	}
+
+	var jobs []job
+	for _, p := range platforms {
+		for _, j := range newJobs(directories, command, args...) {
+			j.env = append(j.env, p.env()...)
+			jobs = append(jobs, j)
+		}
+	}
+
+	fmt.Printf("Running on %d platforms: ", len(platforms))
+	outputs := runPlatformJobs(jobs)
+
+	// Jobs were queued platform by platform, so regroup the outputs by directory
+	results := make(map[string][]cmdOutput, len(directories))
+	for i := range platforms {
+		for d, directory := range directories {
+			results[directory] = append(results[directory], outputs[i*len(directories)+d])
+		}
+	}
+
+	failed := 0
+	for _, directory := range directories {
+		for i, output := range results[directory] {
+			if jobSkipped(output) {
+				skippedJobs++
+			} else if output.err != nil {
+				failed++
+			}
+			if results := strings.TrimSpace(output.output); results != "" && (verbose || output.err != nil) {
+				fmt.Printf("\n\n%s (%s):\n%s", relativePath(directory), platforms[i], results)
+			}
+		}
+	}
+
+	fmt.Print("\n\n")
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := []string{"package"}
+	for _, p := range platforms {
+		header = append(header, p.String())
+	}
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+	for _, directory := range directories {
+		row := []string{relativePath(directory)}
+		for _, output := range results[directory] {
+			if output.err == errExcludedByConstraints {
+				row = append(row, "-")
+			} else if jobSkipped(output) {
+				row = append(row, "skip")
+			} else if output.err != nil {
+				row = append(row, "FAIL")
+			} else {
+				row = append(row, "ok")
+			}
+		}
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	writer.Flush()
+
+	printSummary("packages", "run", len(outputs), failed)
+
+	return failed == 0
+}
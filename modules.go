@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// searchModule is the string for searching for module roots
+	searchModule = "go.mod"
+
+	// modTidy tidies every module
+	modTidy = "tidy"
+
+	// modVerify verifies the dependencies of every module
+	modVerify = "verify"
+
+	// modCheck reports modules that are not tidy, without changing them
+	modCheck = "check"
+)
+
+// moduleFiles are the files go mod tidy may rewrite in a module root
+var moduleFiles = []string{"go.mod", "go.sum"}
+
+// errModuleNotTidy is the error of a module that go mod tidy would change
+var errModuleNotTidy = errors.New("module is not tidy")
+
+// checkModuleTidy fails if the go mod tidy job would change the go.mod or go.sum file
+// of its module, without changing either. From go1.23, go mod tidy -diff reports the
+// changes itself. Earlier releases tidy copies of the files instead, which go mod tidy
+// -modfile allows from go1.14. The job's environment is used either way, so modules
+// are resolved as they are when tidied.
+func checkModuleTidy(j job, release goRelease) cmdOutput {
+	directory := j.directory
+	if release.atLeast(1, 23) {
+		out, err := runShellCommandEnv(directory, j.env, j.command, append(append([]string{}, j.args...), "-diff")...)
+		if err != nil && strings.Contains(out, "--- current/") {
+			return cmdOutput{directory, fmt.Sprintf("%s: go mod tidy would change the module:\n%s", relativePath(directory), out), errModuleNotTidy}
+		}
+		return cmdOutput{directory, out, err}
+	}
+	if !release.atLeast(1, 14) {
+		return cmdOutput{directory, fmt.Sprintf(errorTidyCheckUnsupported, relativePath(directory), release), errModuleNotTidy}
+	}
+
+	copies, err := ioutil.TempDir("", "gorc-mod-check")
+	if err != nil {
+		return cmdOutput{directory, "", err}
+	}
+	defer os.RemoveAll(copies)
+
+	original := make(map[string][]byte)
+	for _, name := range moduleFiles {
+		data, err := ioutil.ReadFile(filepath.Join(directory, name))
+		if err != nil {
+			continue
+		}
+		original[name] = data
+		if err := ioutil.WriteFile(filepath.Join(copies, name), data, 0600); err != nil {
+			return cmdOutput{directory, "", err}
+		}
+	}
+
+	// The go.sum file is read and written next to the file given by -modfile
+	out, err := runShellCommandEnv(directory, j.env, j.command, append(append([]string{}, j.args...), "-modfile="+filepath.Join(copies, searchModule))...)
+	if err != nil {
+		return cmdOutput{directory, out, err}
+	}
+
+	var changed []string
+	for _, name := range moduleFiles {
+		data, readErr := ioutil.ReadFile(filepath.Join(copies, name))
+		previous, existed := original[name]
+		if existed != (readErr == nil) || !bytes.Equal(previous, data) {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) != 0 {
+		return cmdOutput{directory, fmt.Sprintf("%s: go mod tidy would change %s", relativePath(directory), strings.Join(changed, ", ")), errModuleNotTidy}
+	}
+	return cmdOutput{directory, out, nil}
+}
+
+// modModules locates every module root in or below the current working directory and
+// tidies, verifies or checks it, depending on the action.
+func modModules(name, action string, verbose bool) bool {
+	directories := findDirectories(name, searchModule)
+
+	var outputs []cmdOutput
+	switch action {
+	case modTidy:
+		fmt.Print("\nTidying modules: ")
+		outputs = runJobsParallel(newJobs(directories, goCommand, "mod", "tidy"))
+	case modVerify:
+		fmt.Print("\nVerifying modules: ")
+		outputs = runJobsParallel(newJobs(directories, goCommand, "mod", "verify"))
+	case modCheck:
+		fmt.Print("\nChecking modules are tidy: ")
+		release := activeRelease()
+		jobs := newJobs(directories, goCommand, "mod", "tidy")
+		outputs = runParallel(len(jobs), func(index int) cmdOutput {
+			return checkModuleTidy(jobs[index], release)
+		})
+	default:
+		fmt.Printf(errorUnknownModAction, action, modTidy, modVerify, modCheck)
+		return false
+	}
+
+	run, failed := len(outputs), countAndPrintOutputs(outputs, verbose)
+	printSummary("modules", "modules", run, failed)
+	return failed == 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// configKeyOverridePath is the key of an override at which its path pattern is stored
+const configKeyOverridePath = "path"
+
+// overrideKeys are the settings an override may change
+var overrideKeys = []string{configKeyEnv, configKeyFlags, configKeyParallel, configKeyTags, configKeyTimeout}
+
+// configOverride changes settings for the directories matching a path pattern. The
+// pattern has the same syntax as an exclusion, is relative to the directory of the
+// configuration file the override is in, and also matches everything below the
+// directories it names. Later overrides take precedence over earlier ones.
+type configOverride struct {
+	Path     string            `json:"path"`
+	Timeout  string            `json:"timeout,omitempty"`
+	Flags    []string          `json:"flags,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Parallel int               `json:"parallel,omitempty"`
+
+	pattern exclusionPattern
+}
+
+// decodeOverrides decodes and validates a list of overrides. Problems are reported at
+// keys such as "overrides[1].timeout".
+func decodeOverrides(key string, value json.RawMessage) ([]*configOverride, []error) {
+	var raws []map[string]json.RawMessage
+	if json.Unmarshal(value, &raws) != nil {
+		return nil, []error{configError{key, fmt.Sprintf("expected a list of objects, each with a path and the settings to override, got %s", jsonType(value))}}
+	}
+
+	var overrides []*configOverride
+	var errs []error
+	for i, raw := range raws {
+		prefix := fmt.Sprintf("%s[%d]", key, i)
+		override := &configOverride{}
+
+		if pathValue, ok := raw[configKeyOverridePath]; !ok || json.Unmarshal(pathValue, &override.Path) != nil || override.Path == "" {
+			errs = append(errs, configError{prefix + "." + configKeyOverridePath, "expected a path pattern such as \"integration/**\""})
+		} else if strings.HasPrefix(override.Path, patternNegatePrefix) {
+			errs = append(errs, configError{prefix + "." + configKeyOverridePath, "override paths cannot be negated"})
+		} else if pattern, err := compileExclusion(override.Path); err != nil {
+			errs = append(errs, configError{prefix + "." + configKeyOverridePath, err.Error()})
+		} else {
+			override.pattern = pattern
+		}
+		delete(raw, configKeyOverridePath)
+
+		for name := range raw {
+			if allowed, _ := sliceContainsString(name, overrideKeys); !allowed {
+				errs = append(errs, configError{prefix + "." + name, fmt.Sprintf("cannot be overridden; expected one of %s", strings.Join(overrideKeys, ", "))})
+				delete(raw, name)
+			}
+		}
+
+		settings := &configuration{}
+		for _, err := range settings.decode(raw, false) {
+			if keyErr, ok := err.(configError); ok {
+				err = configError{prefix + "." + keyErr.key, keyErr.message}
+			}
+			errs = append(errs, err)
+		}
+		override.Timeout = settings.Timeout
+		override.Flags = settings.Flags
+		override.Env = settings.Env
+		override.Tags = settings.Tags
+		override.Parallel = settings.Parallel
+
+		overrides = append(overrides, override)
+	}
+	return overrides, errs
+}
+
+// appliesTo determines if the override applies to the slash separated path relative to
+// its configuration file: either the path or one of its parent directories matches.
+func (o *configOverride) appliesTo(relativePath string) bool {
+	if relativePath == "." || strings.HasPrefix(relativePath, "../") {
+		return false
+	}
+	for current := relativePath; current != "."; current = path.Dir(current) {
+		if o.pattern.matches(current) {
+			return true
+		}
+	}
+	return false
+}
+
+// settings returns the settings the override changes
+func (o *configOverride) settings() *configuration {
+	return &configuration{Timeout: o.Timeout, Flags: o.Flags, Env: o.Env, Tags: o.Tags, Parallel: o.Parallel}
+}
+
+// environment returns the environment variables in KEY=VALUE form, sorted by key
+func environment(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	variables := make([]string, len(keys))
+	for i, key := range keys {
+		variables[i] = key + "=" + env[key]
+	}
+	return variables
+}
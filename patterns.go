@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// patternRegexpPrefix marks an exclusion pattern as a regular expression
+	patternRegexpPrefix = "re:"
+
+	// patternNegatePrefix marks an exclusion pattern as re-including the directories it matches
+	patternNegatePrefix = "!"
+)
+
+// exclusionPattern is a compiled entry of the exclusion list.
+//
+// Patterns are matched against the slash separated path of a directory relative to
+// the directory of the configuration file holding them, in the manner of .gitignore.
+// For the configuration file at the top of the project, and the user-global one,
+// this is the root of the repository:
+//
+//	mocks              a name without a slash matches a directory of that name at any depth
+//	internal/legacy    a path containing a slash matches relative to the root
+//	internal/*/testdata  * and ? match within a path element, ** matches any number of elements
+//	re:^gen(/|$)       a regular expression matched against the relative path
+//	!internal/keep     re-includes directories excluded by an earlier pattern
+//
+// When several patterns match a directory, the last one wins. As with .gitignore,
+// a directory cannot be re-included if its parent is excluded, because excluded
+// directories are never walked.
+type exclusionPattern struct {
+	source   string
+	negate   bool
+	regexp   *regexp.Regexp
+	glob     string
+	basename bool
+}
+
+// compileExclusion compiles a single exclusion pattern
+func compileExclusion(source string) (exclusionPattern, error) {
+	pattern := exclusionPattern{source: source}
+	expression := source
+
+	if strings.HasPrefix(expression, patternNegatePrefix) {
+		pattern.negate = true
+		expression = expression[len(patternNegatePrefix):]
+	}
+
+	if strings.HasPrefix(expression, patternRegexpPrefix) {
+		compiled, err := regexp.Compile(expression[len(patternRegexpPrefix):])
+		if err != nil {
+			return pattern, fmt.Errorf(errorInvalidPattern, source, err)
+		}
+		pattern.regexp = compiled
+		return pattern, nil
+	}
+
+	expression = strings.TrimSuffix(filepath.ToSlash(expression), "/")
+	if expression == "" {
+		return pattern, fmt.Errorf(errorInvalidPattern, source, "the pattern is empty")
+	}
+	pattern.basename = !strings.Contains(expression, "/")
+	pattern.glob = strings.TrimPrefix(expression, "/")
+
+	// Check the glob is well formed, so mistakes are reported when excluding rather than ignored when walking
+	for _, element := range strings.Split(pattern.glob, "/") {
+		if _, err := path.Match(element, ""); err != nil {
+			return pattern, fmt.Errorf(errorInvalidPattern, source, err)
+		}
+	}
+
+	return pattern, nil
+}
+
+// compileExclusions compiles each of the exclusion patterns in order. Invalid patterns
+// are left out, and the error for the first of them is returned.
+func compileExclusions(sources []string) ([]exclusionPattern, error) {
+	var firstErr error
+	patterns := make([]exclusionPattern, 0, len(sources))
+	for _, source := range sources {
+		pattern, err := compileExclusion(source)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, firstErr
+}
+
+// matches determines if the pattern matches the slash separated relative path,
+// ignoring whether the pattern is negated.
+func (p exclusionPattern) matches(relativePath string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(relativePath)
+	}
+	if p.basename {
+		matched, _ := path.Match(p.glob, path.Base(relativePath))
+		return matched
+	}
+	return matchGlob(strings.Split(p.glob, "/"), strings.Split(relativePath, "/"))
+}
+
+// matchGlob matches path elements against pattern elements, where a ** element
+// matches zero or more path elements.
+func matchGlob(pattern, elements []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for skip := 0; skip <= len(elements); skip++ {
+				if matchGlob(pattern[1:], elements[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elements) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], elements[0]); !matched {
+			return false
+		}
+		pattern, elements = pattern[1:], elements[1:]
+	}
+	return len(elements) == 0
+}
+
+// slashRelativePath returns the slash separated path of directory relative to root
+func slashRelativePath(root, directory string) string {
+	relative, err := filepath.Rel(root, directory)
+	if err != nil {
+		return filepath.ToSlash(directory)
+	}
+	return filepath.ToSlash(relative)
+}
+
+// exclusionMatches walks every directory below root once and returns, for each
+// pattern, the relative paths of the directories it matches. Directories below a match
+// are not listed, since they are excluded (or re-included) along with it.
+func exclusionMatches(root string, patterns []exclusionPattern) map[string][]string {
+	matches := make(map[string][]string)
+	// covered holds, for each pattern, the directories in or below one it matched
+	covered := make([]map[string]bool, len(patterns))
+	for i := range covered {
+		covered[i] = make(map[string]bool)
+	}
+	filepath.WalkDir(root, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || current == root {
+			return nil
+		}
+		if entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		relative := slashRelativePath(root, current)
+		parent := filepath.Dir(current)
+		uncovered := false
+		for i, pattern := range patterns {
+			if covered[i][parent] {
+				covered[i][current] = true
+				continue
+			}
+			if pattern.matches(relative) {
+				matches[pattern.source] = append(matches[pattern.source], relative)
+				covered[i][current] = true
+				continue
+			}
+			uncovered = true
+		}
+		// Nothing below is listed once every pattern has matched above it
+		if !uncovered {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return matches
+}
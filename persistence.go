@@ -5,101 +5,214 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
+// configPath is the path of the project configuration file read and written by gorc
+var configPath = configFilename
+
 // encodeJSON encodes an object to a JSON byte slice
 func encodeJSON(object interface{}) ([]byte, error) {
 	return json.Marshal(object)
 }
 
-// decodeJSON decodes a JSON byte slice into an object
-func decodeJSON(data []byte, object interface{}) error {
-	return json.Unmarshal(data, object)
-}
+// exclude excludes a directory from testing. Only its entry is added to the list, so
+// the comments on the other entries are kept.
+func exclude(directory string) (bool, error) {
+	return updateConfigKey(configPath, configKeyExclusions, func(current json.RawMessage) (json.RawMessage, error) {
+		exclusions, err := currentExclusions(current)
+		if err != nil {
+			return nil, err
+		}
 
-// exclude excludes a directory from testing
-func exclude(directory string, config map[string]interface{}) {
+		// If the directory isn't in the array, add it
+		if contains, _ := sliceContainsString(directory, exclusions); !contains {
+			exclusions = append(exclusions, directory)
+		}
 
-	// If the directory isn't in the array, add it
-	exclusions := config[configKeyExclusions].([]string)
-	if contains, _ := sliceContainsString(directory, exclusions); !contains || exclusions == nil {
-		config[configKeyExclusions] = append(exclusions, directory)
-	}
+		return json.Marshal(exclusions)
+	})
+}
 
-	writeConfig(config)
+// Include includes a directory in testing. Only its entry is removed from the list, so
+// the comments on the other entries are kept.
+func include(directory string) (bool, error) {
+	return updateConfigKey(configPath, configKeyExclusions, func(current json.RawMessage) (json.RawMessage, error) {
+		exclusions, err := currentExclusions(current)
+		if err != nil {
+			return nil, err
+		}
 
-}
+		// If the directory is in the array, remove it
+		if contains, index := sliceContainsString(directory, exclusions); contains {
+			exclusions = append(exclusions[:index], exclusions[index+1:]...)
+		}
 
-// Include includes a directory in testing
-func include(directory string, config map[string]interface{}) {
+		if len(exclusions) == 0 {
+			return nil, nil
+		}
+		return json.Marshal(exclusions)
+	})
+}
 
-	// If the directory is in the array, remove it
-	exclusions := config[configKeyExclusions].([]string)
-	if contains, index := sliceContainsString(directory, exclusions); contains {
-		config[configKeyExclusions] = append(exclusions[:index], exclusions[index+1:]...)
+// currentExclusions decodes the exclusions currently in the configuration file
+func currentExclusions(current json.RawMessage) ([]string, error) {
+	if current == nil {
+		return []string{}, nil
 	}
-
-	writeConfig(config)
+	return decodeStringList(configKeyExclusions, current)
 }
 
 // Set a timeout for testing
-func timeoutAfter(timeout string, config map[string]interface{}) {
-	config[configKeyTimeout] = timeout
-	writeConfig(config)
+func timeoutAfter(timeout string) (bool, error) {
+	value, _ := json.Marshal(timeout)
+	return editConfigKey(configPath, configKeyTimeout, value)
 }
 
-// configEmpty determines if the configuration object is empty, allowing the configuration file to be deleted
-func configEmpty(config map[string]interface{}) bool {
+// writeConfigFile writes the configuration to disk at path. The caller must hold the
+// configuration lock.
+func writeConfigFile(path string, config *configuration) error {
 
-	empty := false
+	// The configuration is empty. Delete the file.
+	if config.empty() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
 
-	if len(config[configKeyExclusions].([]string)) == 0 &&
-		len(config[configKeyTimeout].(string)) == 0 {
-		empty = true
+	data, error := encodeJSON(config)
+	if error == nil {
+		data, error = encodeConfigFile(path, data)
 	}
+	if error == nil {
+		error = writeFileAtomic(path, data)
+	}
+	return error
+}
 
-	return empty
+// writeFileAtomic writes data to a temporary file beside path and renames it into place,
+// so the file at path is never left partially written. The file keeps its permissions.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
 
-}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
 
-// writeConfig writes the configuration to disk
-func writeConfig(config map[string]interface{}) {
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
 
-	// The configuration is empty. Delete the file.
-	if configEmpty(config) {
-		os.Remove(configFilename)
-	} else {
+// migrateConfigData returns the contents of a configuration file from an older version
+// of gorc with the keys that may have changed brought up to date, keeping the rest of
+// the file as it was, and whether anything needed migrating. Files that cannot be
+// parsed are returned unchanged.
+func migrateConfigData(path string, data []byte) ([]byte, bool, error) {
+	config, migrated, errs := parseConfigFile(path, data)
+	if len(errs) != 0 || !migrated {
+		return data, false, nil
+	}
 
-		data, error := encodeJSON(config)
+	var error error
+	edit := formatForPath(path).edit
+	if config.Timeout != "" {
+		timeout, _ := json.Marshal(config.Timeout)
+		data, error = edit(data, configKeyTimeout, timeout)
+	}
+	if error == nil {
+		data, error = edit(data, configKeyVersion, json.RawMessage(fmt.Sprint(config.Version)))
+	}
+	return data, true, error
+}
 
-		if error != nil {
-			fmt.Printf("\n%s\n\n", errorSavingFile)
-		}
+// migrateConfigFile saves the configuration file at path in the current format if it
+// was written by an older version of gorc, returning whether it needed migrating. The
+// file is read and written while holding the configuration lock.
+func migrateConfigFile(path string) (bool, error) {
+	unlock, error := lockConfigFile(path)
+	if error != nil {
+		return false, error
+	}
+	defer unlock()
 
-		error = ioutil.WriteFile(configFilename, data, 0644)
+	data, error := ioutil.ReadFile(path)
+	if error != nil {
+		return false, error
+	}
+	if _, _, errs := parseConfigFile(path, data); len(errs) != 0 {
+		return false, errs[0]
+	}
+	data, migrated, error := migrateConfigData(path, data)
+	if error != nil || !migrated {
+		return false, error
+	}
+	return true, writeFileAtomic(path, data)
+}
 
-		if error != nil {
-			fmt.Printf("\n%s\n\n", errorSavingFile)
+// migrateConfigFiles saves each of the configuration files written by an older version
+// of gorc in the current format, printing those that were migrated, and returns
+// whether they all could be.
+func migrateConfigFiles(paths []string) bool {
+	failed := 0
+	fmt.Println()
+	for _, path := range paths {
+		migrated, err := migrateConfigFile(path)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("%s:\n\t%s\n", path, err)
+		case migrated:
+			fmt.Printf("Migrated %s to configuration version %d.\n", path, currentConfigVersion)
 		}
 	}
+	fmt.Printf("\n%d files. %d succeeded. %d failed.\n\n", len(paths), len(paths)-failed, failed)
+	return failed == 0
+}
 
+// readConfig reads the project configuration file from disk
+func readConfig() *configuration {
+	return readConfigFile(configPath)
 }
 
-// readConfig reads the configuration from disk
-func readConfig() map[string]interface{} {
-	var config = make(map[string]interface{})
-	config[configKeyExclusions] = make([]string, 0)
-	config[configKeyTimeout] = ""
+// readConfigFile reads the configuration file at path from disk. Files written for an
+// older version of gorc are migrated as they are read, but are only saved in the
+// current format when they are edited or migrated with gorc config.
+func readConfigFile(path string) *configuration {
 
 	// If a configuration file exists, load and decode it
-	if fileData, fileError := ioutil.ReadFile(configFilename); fileError == nil {
-		if decodeError := decodeJSON(fileData, &config); decodeError != nil {
-			fmt.Printf("There was an error parsing your configuration file: %s\n\n", decodeError)
-			os.Exit(1)
-		} else {
-			// Convert the []interface{} to []string to make life easier
-			config[configKeyExclusions] = stringSliceFromInterfaceSlice(config[configKeyExclusions].([]interface{}))
+	fileData, fileError := ioutil.ReadFile(path)
+	if fileError != nil {
+		return newConfiguration()
+	}
+
+	config, _, errs := parseConfigFile(path, fileData)
+	if len(errs) != 0 {
+		fmt.Printf("There was an error parsing your configuration file %s:\n", path)
+		for _, err := range errs {
+			fmt.Printf("\t%s\n", err)
 		}
+		fmt.Println()
+		os.Exit(1)
 	}
 	return config
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcludeIncludeKeepComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     string
+		excluded string
+		included string
+	}{
+		{
+			name:     "yaml",
+			filename: configFilename + ".yaml",
+			data: `version: 1
+exclusions:
+  - mocks # generated by mockery
+  - legacy # to be deleted
+`,
+			excluded: `version: 1
+exclusions:
+  - mocks # generated by mockery
+  - legacy # to be deleted
+  - vendor
+`,
+			included: `version: 1
+exclusions:
+  - legacy # to be deleted
+  - vendor
+`,
+		},
+		{
+			name:     "toml",
+			filename: configFilename + ".toml",
+			data: `version = 1
+exclusions = [
+  "mocks", # generated by mockery
+  "legacy", # to be deleted
+]
+`,
+			excluded: `version = 1
+exclusions = [
+  "mocks", # generated by mockery
+  "legacy", # to be deleted
+  "vendor",
+]
+`,
+			included: `version = 1
+exclusions = [
+  "legacy", # to be deleted
+  "vendor",
+]
+`,
+		},
+	}
+
+	previous := configPath
+	defer func() { configPath = previous }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configPath = filepath.Join(t.TempDir(), test.filename)
+			if err := ioutil.WriteFile(configPath, []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := exclude("vendor"); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := ioutil.ReadFile(configPath); string(data) != test.excluded {
+				t.Errorf("after exclude got\n%s\nwant\n%s", data, test.excluded)
+			}
+
+			if _, err := include("mocks"); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := ioutil.ReadFile(configPath); string(data) != test.included {
+				t.Errorf("after include got\n%s\nwant\n%s", data, test.included)
+			}
+		})
+	}
+}
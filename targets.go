@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// targetAll is the target that selects every package, including excluded ones
+const targetAll = "all"
+
+// packageTarget is a single entry of the name argument. An entry is one of:
+//
+//	api                   a name without a slash selects every directory of that name
+//	services/billing      a relative path selects that directory
+//	services/billing/...  a ... pattern selects a directory and everything below it
+//	internal/*/store      a glob, where * and ? match within a path element and ** matches any number of elements
+//	example.com/m/api     an import path within a module in the project selects that package
+//
+// Directories selected by name, path or import path are run even if they are excluded.
+type packageTarget struct {
+	source string
+	exact  bool
+	match  func(relativePath string) bool
+}
+
+// packageTargets is the set of packages selected by the name argument
+type packageTargets []packageTarget
+
+// parseTargets parses the comma separated entries of the name argument. Relative paths
+// and import paths are resolved against directory, the directory gorc is run in.
+func parseTargets(target, directory string) (packageTargets, error) {
+	modules := projectModules(directory)
+
+	var targets packageTargets
+	for _, source := range splitList(target) {
+		resolved := resolveImportPath(source, directory, modules)
+		resolved = strings.TrimPrefix(path.Clean(filepath.ToSlash(resolved)), "./")
+
+		switch {
+		case strings.Contains(resolved, "..."):
+			expression := regexp.QuoteMeta(resolved)
+			if strings.HasSuffix(expression, `/\.\.\.`) {
+				// As with the go command, x/... also matches x itself
+				expression = strings.TrimSuffix(expression, `/\.\.\.`) + `(/\.\.\.)?`
+			}
+			expression = strings.Replace(expression, `\.\.\.`, `.*`, -1)
+			if resolved == "..." {
+				expression = ".*"
+			}
+			compiled, err := regexp.Compile("^" + expression + "$")
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, packageTarget{source, false, compiled.MatchString})
+		case strings.ContainsAny(resolved, "*?["):
+			pattern, err := compileExclusion(resolved)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, packageTarget{source, false, pattern.matches})
+		case !strings.Contains(resolved, "/") && resolved == source:
+			targets = append(targets, packageTarget{source, true, func(relativePath string) bool {
+				return path.Base(relativePath) == resolved
+			}})
+		default:
+			targets = append(targets, packageTarget{source, true, func(relativePath string) bool {
+				return relativePath == resolved
+			}})
+		}
+	}
+	return targets, nil
+}
+
+// hasExact determines if any of the targets names a directory directly
+func (t packageTargets) hasExact() bool {
+	for _, target := range t {
+		if target.exact {
+			return true
+		}
+	}
+	return false
+}
+
+// selects determines if the targets select the directory at the slash separated
+// relative path, and if so whether it was named directly
+func (t packageTargets) selects(relativePath string) (selected, exact bool) {
+	for _, target := range t {
+		if target.match(relativePath) {
+			selected = true
+			exact = exact || target.exact
+		}
+	}
+	return selected, exact
+}
+
+// projectModules returns the directory of each module gorc may run in, keyed by module
+// path: the module enclosing directory and, in a go workspace, the workspace modules.
+func projectModules(directory string) map[string]string {
+	modules := make(map[string]string)
+	for current := directory; ; current = filepath.Dir(current) {
+		if modulePath := readModulePath(current); modulePath != "" {
+			modules[modulePath] = current
+			break
+		}
+		if filepath.Dir(current) == current {
+			break
+		}
+	}
+	for _, module := range workspaceModules {
+		if modulePath := readModulePath(module); modulePath != "" {
+			modules[modulePath] = module
+		}
+	}
+	return modules
+}
+
+// readModulePath returns the module path declared by the go.mod file in directory, or
+// an empty string if there is none
+func readModulePath(directory string) string {
+	file, err := os.Open(filepath.Join(directory, searchModule))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "module ") || strings.HasPrefix(line, "module\t") {
+			return strings.Trim(strings.TrimSpace(line[len("module"):]), "\"`")
+		}
+	}
+	return ""
+}
+
+// resolveImportPath converts an import path within one of the modules to a path
+// relative to directory. Anything else is returned unchanged.
+func resolveImportPath(target, directory string, modules map[string]string) string {
+	longest := ""
+	for modulePath := range modules {
+		if (target == modulePath || strings.HasPrefix(target, modulePath+"/")) && len(modulePath) > len(longest) {
+			longest = modulePath
+		}
+	}
+	if longest == "" {
+		return target
+	}
+	absolute := filepath.Join(modules[longest], filepath.FromSlash(strings.TrimPrefix(target, longest)))
+	relative, err := filepath.Rel(directory, absolute)
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(relative)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/objx"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// passthroughSeparator separates gorc's arguments from flags passed to go test unchanged
+const passthroughSeparator = "--"
+
+// testFlags holds the go test flags given as arguments, added to every test run
+var testFlags []string
+
+// testRunFilter and testSkipFilter match the names of the top level tests selected by
+// the run and skip arguments, or are nil if they were not given
+var testRunFilter, testSkipFilter *regexp.Regexp
+
+// testFunction matches the declaration of a function that may be a test, example or
+// fuzz test in a test file, which isTestName then decides
+var testFunction = regexp.MustCompile(`(?m)^func\s+((?:Test|Example|Fuzz)[\p{L}\p{N}_]*)\s*\(`)
+
+// testPrefixes are the prefixes of the names of the functions go test runs
+var testPrefixes = []string{"Test", "Example", "Fuzz"}
+
+// isTestName determines if go test would run the function with the given name, which
+// it does if the name is a test prefix alone or is followed by a rune that is not a
+// lowercase letter, as in TestParse but not Testify. TestMain sets up the tests rather
+// than being one.
+func isTestName(name string) bool {
+	if name == "TestMain" {
+		return false
+	}
+	for _, prefix := range testPrefixes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if len(name) == len(prefix) {
+			return true
+		}
+		r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+		return !unicode.IsLower(r)
+	}
+	return false
+}
+
+// splitPassthrough splits the command line at the first "--", returning the arguments
+// before it and the go test flags after it
+func splitPassthrough(arguments []string) ([]string, []string) {
+	for i, argument := range arguments {
+		if argument == passthroughSeparator {
+			return arguments[:i], arguments[i+1:]
+		}
+	}
+	return arguments, nil
+}
+
+// topLevelPattern returns the part of a -run or -skip pattern that matches top level
+// test names. As with go test, the levels of subtests are separated by slashes.
+func topLevelPattern(pattern string) string {
+	depth := 0
+	for i, character := range pattern {
+		switch character {
+		case '[', '(':
+			depth++
+		case ']', ')':
+			depth--
+		case '/':
+			if depth == 0 {
+				return pattern[:i]
+			}
+		}
+	}
+	return pattern
+}
+
+// parseTestArgs reads the arguments that filter and control tests, setting testFlags
+// and the test name filters. Flags given after "--" are added last, unchanged.
+func parseTestArgs(args objx.Map, passthrough []string) error {
+	testFlags = nil
+	testRunFilter, testSkipFilter = nil, nil
+
+	if run := parseStringArg(args, "run"); run != "" {
+		filter, err := regexp.Compile(topLevelPattern(run))
+		if err != nil {
+			return fmt.Errorf(errorInvalidTestArg, "run", run, err)
+		}
+		testRunFilter = filter
+		testFlags = append(testFlags, "-run="+run)
+	}
+	if skip := parseStringArg(args, "skip"); skip != "" {
+		filter, err := regexp.Compile(topLevelPattern(skip))
+		if err != nil {
+			return fmt.Errorf(errorInvalidTestArg, "skip", skip, err)
+		}
+		// A skip pattern naming subtests does not skip the whole top level test
+		if topLevelPattern(skip) == skip {
+			testSkipFilter = filter
+		}
+		testFlags = append(testFlags, "-skip="+skip)
+	}
+	if parseBoolArg(args, "short") {
+		testFlags = append(testFlags, "-short")
+	}
+	if count := parseStringArg(args, "count"); count != "" {
+		if value, err := strconv.Atoi(count); err != nil || value < 1 {
+			return fmt.Errorf(errorInvalidTestArg, "count", count, "expected a whole number of at least 1")
+		}
+		testFlags = append(testFlags, "-count="+count)
+	}
+	if shuffle := parseStringArg(args, "shuffle"); shuffle != "" {
+		if _, err := strconv.ParseInt(shuffle, 10, 64); err != nil && shuffle != "on" && shuffle != "off" {
+			return fmt.Errorf(errorInvalidTestArg, "shuffle", shuffle, "expected on, off or a seed")
+		}
+		testFlags = append(testFlags, "-shuffle="+shuffle)
+	}
+
+	testFlags = append(testFlags, passthrough...)
+	return nil
+}
+
+// hasMatchingTests determines if any test file in directory declares a top level test
+// selected by the run and skip arguments. Without those arguments, every directory
+// with tests matches.
+func hasMatchingTests(directory string) bool {
+	if testRunFilter == nil && testSkipFilter == nil {
+		return true
+	}
+	files, err := filepath.Glob(filepath.Join(directory, "*"+searchTest))
+	if err != nil {
+		return true
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			// Let go test report the problem
+			return true
+		}
+		for _, match := range testFunction.FindAllStringSubmatch(string(data), -1) {
+			name := match[1]
+			if !isTestName(name) {
+				continue
+			}
+			if testRunFilter != nil && !testRunFilter.MatchString(name) {
+				continue
+			}
+			if testSkipFilter != nil && testSkipFilter.MatchString(name) {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// testArgsDescription describes the test filtering arguments for the help text
+const testArgsDescription = " The run and skip arguments select tests by name as go test -run and -skip do, and packages with no matching tests are not run. The short argument passes -short, count passes -count and shuffle passes -shuffle (on, off or a seed). Any other go test flags may be given after --, as in: gorc test -- -v -failfast -cpu=1,4"
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// goRelease is a major and minor Go release, such as go1.22, along with the full
+// version it was read from, if any
+type goRelease struct {
+	major   int
+	minor   int
+	version string
+}
+
+// String returns the full version of the release, or the release in goX.Y form
+func (r goRelease) String() string {
+	if r.version != "" {
+		return r.version
+	}
+	return fmt.Sprintf("go%d.%d", r.major, r.minor)
+}
+
+// atLeast determines if the release is the given release or a later one
+func (r goRelease) atLeast(major, minor int) bool {
+	return r.major > major || (r.major == major && r.minor >= minor)
+}
+
+// hasBuildCache determines if the release caches build results, so go test no longer
+// needs -i to install the dependencies of tests
+func (r goRelease) hasBuildCache() bool {
+	return r.atLeast(1, 10)
+}
+
+// parseGoRelease parses the release from a go version string such as go1.22.3,
+// go1.23rc1 or go1.24-devel_abc
+func parseGoRelease(version string) (goRelease, bool) {
+	if !strings.HasPrefix(version, "go") {
+		return goRelease{}, false
+	}
+	parts := strings.SplitN(version[len("go"):], ".", 3)
+	if len(parts) < 2 {
+		return goRelease{}, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return goRelease{}, false
+	}
+	minor := parts[1]
+	for i, r := range minor {
+		if r < '0' || r > '9' {
+			minor = minor[:i]
+			break
+		}
+	}
+	minorNumber, err := strconv.Atoi(minor)
+	if err != nil {
+		return goRelease{}, false
+	}
+	return goRelease{major, minorNumber, version}, true
+}
+
+// patch returns the patch number of the release's version, or -1 if the version has
+// none, as for release candidates
+func (r goRelease) patch() int {
+	parts := strings.SplitN(strings.TrimPrefix(r.version, "go"), ".", 3)
+	if len(parts) < 3 {
+		return -1
+	}
+	patch, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return -1
+	}
+	return patch
+}
+
+// unknownRelease is assumed for a go command whose version cannot be worked out, so
+// that no flags are withheld from it
+var unknownRelease = goRelease{1, 1 << 16, "unknown version"}
+
+// toolchainDescription describes the go argument in the help of the commands that take it
+const toolchainDescription = " The go argument runs the command under each of a comma separated list of go releases (e.g. go=go1.22,go1.23), using an installed goX.Y wrapper or else GOTOOLCHAIN, which needs a full release such as go1.22.5, and reports the results for each."
+
+// goCommand is the go command gorc runs, which is changed to run under another toolchain
+var goCommand = "go"
+
+// toolchains are the go releases given by the go argument to run the command under
+var toolchains []string
+
+// testFlagReleases are the first releases supporting go test flags that older
+// releases reject
+var testFlagReleases = map[string]goRelease{
+	"-fullpath": {1, 21, ""},
+	"-shuffle":  {1, 17, ""},
+	"-skip":     {1, 20, ""},
+}
+
+// selectingTestFlags are the go test flags that select which tests run, so they cannot
+// be left out for releases that do not support them
+var selectingTestFlags = map[string]bool{
+	"-skip": true,
+}
+
+// toolchainReleases holds the release of each go command that has been asked for,
+// keyed by the command and the environment it was run with
+var toolchainReleases = make(map[string]goRelease)
+
+// toolchainRelease returns the release of the go command, as reported by its version
+// subcommand
+func toolchainRelease(command string) (goRelease, error) {
+	key := strings.Join(append([]string{command}, commandEnvironment...), "\x00")
+	if release, ok := toolchainReleases[key]; ok {
+		return release, nil
+	}
+	output, err := runShellCommandEnv("", nil, command, "version")
+	if err != nil {
+		return goRelease{}, fmt.Errorf(errorToolchainVersion, command, strings.TrimSpace(output))
+	}
+	// The output is like "go version go1.22.3 linux/amd64", or for a development
+	// build "go version devel go1.23-abc123 Tue Jan 2 15:04:05 2024 +0000 linux/amd64"
+	for _, field := range strings.Fields(output) {
+		if release, ok := parseGoRelease(field); ok {
+			toolchainReleases[key] = release
+			return release, nil
+		}
+	}
+	return goRelease{}, fmt.Errorf(errorToolchainVersion, command, strings.TrimSpace(output))
+}
+
+// activeRelease returns the release of the go command gorc is running
+func activeRelease() goRelease {
+	release, err := toolchainRelease(goCommand)
+	if err != nil {
+		return unknownRelease
+	}
+	return release
+}
+
+// supportedTestFlags returns the go test flags that release supports, printing a
+// warning for each that it does not. Leaving out a flag that selects tests would run
+// tests that were meant to be skipped, so an error is returned for those instead.
+func supportedTestFlags(flags []string, release goRelease) ([]string, error) {
+	var supported []string
+	for _, flag := range flags {
+		name := flag
+		if equals := strings.Index(name, "="); equals != -1 {
+			name = name[:equals]
+		}
+		if first, ok := testFlagReleases[name]; ok && !release.atLeast(first.major, first.minor) {
+			if selectingTestFlags[name] {
+				return nil, fmt.Errorf(errorUnsupportedTestFlag, release, name, first)
+			}
+			fmt.Printf("Warning: %s does not support %s, so it was left out.\n", release, name)
+			continue
+		}
+		supported = append(supported, flag)
+	}
+	return supported, nil
+}
+
+// resolveToolchain works out how to run the go release named, returning the go
+// command to run and any environment variables it needs. An installed goX.Y or
+// goX.Y.Z wrapper (from golang.org/dl) is used if there is one on the PATH, taking the
+// latest patch release if only goX.Y is named. Otherwise the active go command is made
+// to switch toolchains with GOTOOLCHAIN, which needs go1.21 or later. GOTOOLCHAIN
+// cannot pick the latest patch release, so it must be named in full, as in go1.22.5.
+func resolveToolchain(name string) (string, []string, error) {
+	release, ok := parseGoRelease(name)
+	if !ok {
+		return "", nil, fmt.Errorf(errorInvalidToolchain, name)
+	}
+	if wrapper := findToolchainWrapper(release); wrapper != "" {
+		return wrapper, nil, nil
+	}
+
+	active, err := toolchainRelease("go")
+	if err != nil {
+		return "", nil, err
+	}
+	if !active.atLeast(1, 21) {
+		return "", nil, fmt.Errorf(errorToolchainNotFound, name, active)
+	}
+	if release.minorOnly() {
+		return "", nil, fmt.Errorf(errorToolchainPatchNeeded, name, name)
+	}
+	return "go", []string{"GOTOOLCHAIN=" + name}, nil
+}
+
+// minorOnly determines if the release's version names only the major and minor
+// release, as go1.22 does
+func (r goRelease) minorOnly() bool {
+	return r.version == fmt.Sprintf("go%d.%d", r.major, r.minor)
+}
+
+// findToolchainWrapper returns the name of the installed go command wrapper for the
+// release, or an empty string if there is none
+func findToolchainWrapper(release goRelease) string {
+	if _, err := exec.LookPath(release.version); err == nil {
+		return release.version
+	}
+	if !release.minorOnly() {
+		return ""
+	}
+
+	wrapper := goRelease{}
+	for _, directory := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, _ := filepath.Glob(filepath.Join(directory, release.version+".*"))
+		for _, match := range matches {
+			candidate, ok := parseGoRelease(strings.TrimSuffix(filepath.Base(match), ".exe"))
+			if ok && candidate.patch() > wrapper.patch() {
+				if _, err := exec.LookPath(candidate.version); err == nil {
+					wrapper = candidate
+				}
+			}
+		}
+	}
+	return wrapper.version
+}
+
+// forEachToolchain calls run once under each toolchain given by the go argument, or
+// once under the active go command if none were given, adapting the test flags to each
+// toolchain. Under several toolchains, the results for each are reported at the end.
+// It returns whether every run succeeded.
+func forEachToolchain(run func() bool) bool {
+	requestedFlags := testFlags
+	defer func() { testFlags = requestedFlags }()
+
+	if len(toolchains) == 0 {
+		flags, err := supportedTestFlags(requestedFlags, activeRelease())
+		if err != nil {
+			fmt.Printf("\n%s\n\n", err)
+			return false
+		}
+		testFlags = flags
+		return run()
+	}
+
+	command, environment := goCommand, commandEnvironment
+	defer func() { goCommand, commandEnvironment = command, environment }()
+
+	succeeded := make([]bool, len(toolchains))
+	for i, name := range toolchains {
+		goCommand, commandEnvironment = command, environment
+		toolchainCommand, env, err := resolveToolchain(name)
+		if err == nil {
+			goCommand = toolchainCommand
+			commandEnvironment = append(append([]string{}, environment...), env...)
+			var release goRelease
+			if release, err = toolchainRelease(goCommand); err == nil {
+				fmt.Printf("\nToolchain %s (%s)\n", name, release)
+				if testFlags, err = supportedTestFlags(requestedFlags, release); err == nil {
+					succeeded[i] = run()
+				}
+			}
+		}
+		if err != nil {
+			fmt.Printf("\nToolchain %s\n\n%s\n\n", name, err)
+		}
+	}
+
+	failed := 0
+	fmt.Println("\nToolchains:")
+	for i, name := range toolchains {
+		result := "succeeded"
+		if !succeeded[i] {
+			result = "failed"
+			failed++
+		}
+		fmt.Printf("\t%s\t%s\n", name, result)
+	}
+	count := len(toolchains)
+	fmt.Printf("\n%d run. %d succeeded. %d failed. [%.0f%% success]\n\n", count, count-failed, failed, (float32((count-failed))/float32(count))*100)
+	return failed == 0
+}
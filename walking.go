@@ -3,47 +3,232 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 )
 
-// callbackHandler is the function signature of the function to be called when a match
-// is found during recursion
-type callbackHandler func(currentDirectory string)
+// callbackHandler is the function signature of the function to be called for each
+// directory walked during recursion. It is told whether the directory contains a
+// file matching the search string.
+type callbackHandler func(currentDirectory string, matched bool)
 
-// skipHandler is the function signature of the function to be called to determine if a directory should be skipped
+// skipHandler is the function signature of the function to be called to determine if a directory should be skipped.
+// It is passed the full path of the directory.
 type skipHandler func(currentDirectory string) bool
 
-func recurseDirectories(directory, targetDirectory string, searchString string, skip skipHandler, callback callbackHandler) {
-	directoryHandle, error := os.Open(directory)
-	if error != nil {
-		fmt.Printf(errorRecursingDirectories, error)
-		os.Exit(1)
+// walkError describes a directory that could not be read during recursion
+type walkError struct {
+	directory string
+	err       error
+}
+
+func (e walkError) Error() string {
+	return fmt.Sprintf("%s: %s", relativePath(e.directory), e.err)
+}
+
+// recurseDirectories walks the directory tree, calling callback for each directory
+// walked, in sorted order, along with whether it contains a file matching searchString. Directories that cannot
+// be read are skipped and returned as errors, and the rest of the tree is still walked.
+//
+// Directories are read concurrently by up to walkWorkers goroutines, using only the
+// type of each entry rather than a full stat, so skip may be called concurrently.
+// Skipped directories are pruned before they are read.
+//
+// If followSymlinks is set, symbolic links to directories are walked too, once the
+// rest of the tree has been, so a directory reached both directly and through a link
+// is reported at its own path. Every directory is identified by its device and inode,
+// so each is only walked once, however many paths lead to it, and links that form
+// cycles are not followed around.
+func recurseDirectories(directory string, searchString string, skip skipHandler, callback callbackHandler) []error {
+	w := &walk{searchString: searchString, skip: skip, visited: make(map[string]bool), found: make(map[string]bool), slots: make(chan struct{}, walkWorkers)}
+	w.start(directory)
+	w.wait.Wait()
+	for len(w.links) != 0 {
+		links := w.links
+		w.links = nil
+		for _, link := range links {
+			w.start(link)
+		}
+		w.wait.Wait()
 	}
-	files, error := directoryHandle.Readdir(-1)
-	if error != nil {
-		fmt.Printf(errorRecursingDirectories, error)
-		os.Exit(1)
+
+	sort.Strings(w.walked)
+	for _, walked := range w.walked {
+		callback(walked, w.found[walked])
+	}
+	sort.Slice(w.errs, func(i, j int) bool {
+		return w.errs[i].Error() < w.errs[j].Error()
+	})
+	return w.errs
+}
+
+// walkWorkers is the most directories read at once while walking, besides the caller.
+// Reading directories waits on the file system rather than the CPU, especially on
+// network mounts, so many more may be read at once than there are CPUs.
+var walkWorkers = 32
+
+// readDirectory reads the entries of a directory while walking
+var readDirectory = os.ReadDir
+
+// walk holds the state of a single recursion through the directory tree
+type walk struct {
+	searchString string
+	skip         skipHandler
+
+	// slots limits how many goroutines read directories at once
+	slots chan struct{}
+	wait  sync.WaitGroup
+
+	// lock guards the fields below
+	lock sync.Mutex
+
+	// visited holds the identity of every directory walked when following symlinks
+	visited map[string]bool
+
+	// links holds the symbolic links to directories waiting to be walked
+	links []string
+
+	walked []string
+	found  map[string]bool
+	errs   []error
+}
+
+// start walks directory in a new goroutine if a slot is free, or else in the current one
+func (w *walk) start(directory string) {
+	select {
+	case w.slots <- struct{}{}:
+		w.wait.Add(1)
+		go func() {
+			defer func() {
+				<-w.slots
+				w.wait.Done()
+			}()
+			w.directory(directory)
+		}()
+	default:
+		w.directory(directory)
+	}
+}
+
+// fail records a directory that could not be read
+func (w *walk) fail(directory string, err error) {
+	w.lock.Lock()
+	w.errs = append(w.errs, walkError{directory, err})
+	w.lock.Unlock()
+}
+
+// firstVisit records that directory is being walked, returning false if it has been
+// walked already through another path
+func (w *walk) firstVisit(directory string) bool {
+	info, err := os.Stat(directory)
+	if err != nil {
+		w.fail(directory, err)
+		return false
+	}
+	identity, ok := directoryIdentity(directory, info)
+	if !ok {
+		return true
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.visited[identity] {
+		return false
+	}
+	w.visited[identity] = true
+	return true
+}
+
+// directory walks directory and everything below it, except for symbolic links, which
+// are queued to be walked later
+func (w *walk) directory(directory string) {
+	if followSymlinks && !w.firstVisit(directory) {
+		return
+	}
+
+	entries, err := readDirectory(directory)
+	if err != nil {
+		// Any entries read before the error are still walked
+		w.fail(directory, err)
 	}
 
 	searchStringFound := false
-	directoryParts := strings.Split(directory, string(os.PathSeparator))
-	directoryName := directoryParts[len(directoryParts)-1]
 
-	for _, file := range files {
-		if file.IsDir() && directoryName != targetDirectory {
-			if skip(file.Name()) {
+	for _, entry := range entries {
+		subdirectory := fmt.Sprintf("%s/%s", directory, entry.Name())
+		isDirectory := entry.IsDir()
+		if followSymlinks && entry.Type()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(subdirectory); err == nil && target.IsDir() {
+				if !w.skip(subdirectory) {
+					w.lock.Lock()
+					w.links = append(w.links, subdirectory)
+					w.lock.Unlock()
+				}
 				continue
 			}
-			recurseDirectories(fmt.Sprintf("%s/%s", directory, file.Name()), targetDirectory, searchString, skip, callback)
+		}
+		if isDirectory {
+			if w.skip(subdirectory) {
+				continue
+			}
+			w.start(subdirectory)
 		} else {
-			if searchStringFound == false && strings.Contains(file.Name(), searchString) {
+			if searchStringFound == false && strings.HasSuffix(entry.Name(), w.searchString) {
 				searchStringFound = true
 			}
 		}
 	}
 
-	if (searchStringFound && (targetDirectory == "" || targetDirectory == "all")) || (searchStringFound && directoryName == targetDirectory) {
-		// We found our search string, call the handler
-		callback(directory)
+	w.lock.Lock()
+	w.walked = append(w.walked, directory)
+	w.found[directory] = searchStringFound
+	w.lock.Unlock()
+}
+
+// followSymlinks makes the walker follow symbolic links to directories
+var followSymlinks bool
+
+// walkWarnings holds the directories that could not be read while walking and have
+// not been reported yet
+var walkWarnings []error
+
+// strictWalk makes any directory that cannot be read while walking fail the run
+var strictWalk bool
+
+// recordWalkErrors handles the errors from walking. In strict mode they are fatal;
+// otherwise each unreadable directory is kept to be reported with the summary.
+func recordWalkErrors(errs []error) {
+	if len(errs) == 0 {
+		return
+	}
+	if strictWalk {
+		for _, err := range errs {
+			fmt.Printf(errorRecursingDirectories+"\n", err)
+		}
+		fmt.Println()
+		os.Exit(1)
+	}
+	for _, err := range errs {
+		known := false
+		for _, warning := range walkWarnings {
+			known = known || warning.Error() == err.Error()
+		}
+		if !known {
+			walkWarnings = append(walkWarnings, err)
+		}
+	}
+}
+
+// printWalkWarnings prints the directories that could not be read while walking, so
+// they are reported alongside the summary. Each is only reported once.
+func printWalkWarnings() {
+	if len(walkWarnings) == 0 {
+		return
+	}
+	fmt.Printf("Warning: %d directories could not be read and were skipped (use strict=true to fail instead):\n", len(walkWarnings))
+	for _, warning := range walkWarnings {
+		fmt.Printf("\t%s\n", warning)
 	}
+	fmt.Println()
+	walkWarnings = nil
 }
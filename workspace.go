@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// workspaceFilename is the name of the go workspace file
+const workspaceFilename = "go.work"
+
+// parseWorkspace returns the module directories listed by the use directives of a
+// go.work file, resolved relative to directory.
+func parseWorkspace(data []byte, directory string) []string {
+	var modules []string
+	inUseBlock := false
+
+	addModule := func(path string) {
+		path = strings.Trim(strings.TrimSpace(path), "\"`")
+		if path == "" {
+			return
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(directory, filepath.FromSlash(path))
+		}
+		if contains, _ := sliceContainsString(path, modules); !contains {
+			modules = append(modules, path)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "//"); index >= 0 {
+			line = line[:index]
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case inUseBlock && line == ")":
+			inUseBlock = false
+		case inUseBlock:
+			addModule(line)
+		case strings.HasPrefix(line, "use ") || strings.HasPrefix(line, "use\t") || strings.HasPrefix(line, "use("):
+			if rest := strings.TrimSpace(line[len("use"):]); rest == "(" {
+				inUseBlock = true
+			} else {
+				addModule(rest)
+			}
+		}
+	}
+	return modules
+}
+
+// readWorkspace reads the go.work file in directory, if there is one, returning the
+// path to the file and the module directories it uses. Setting GOWORK=off disables
+// workspace mode, as it does for the go command.
+func readWorkspace(directory string) (string, []string, error) {
+	if os.Getenv("GOWORK") == "off" {
+		return "", nil, nil
+	}
+	path := filepath.Join(directory, workspaceFilename)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	return path, parseWorkspace(data, directory), nil
+}
+
+// isModuleRoot determines if the directory contains a go.mod file
+func isModuleRoot(directory string) bool {
+	info, err := os.Stat(filepath.Join(directory, searchModule))
+	return err == nil && !info.IsDir()
+}